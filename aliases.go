@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// validateAliasTags returns an error if alias tags cannot be used for the
+// image. The templates themselves are parsed by compileTagTemplates.
+func (img *RenamedImage) validateAliasTags() error {
+	if len(img.AliasTags) > 0 && img.Semver == "" {
+		return fmt.Errorf("cannot use %q without a defined %q", "alias_tags", "semver")
+	}
+	return nil
+}
+
+// aliasTags returns a map of alias tag -> source tag with the highest version
+// among matched tags rendering to the alias. Prereleases are not aliased, and
+// aliases equal to a destination tag of any matched tag are skipped.
+// Example: ["v1.11.1", "v1.11.3", "v1.12.0"] with "{{.Major}}.{{.Minor}}" ->
+// {"1.11": "v1.11.3", "1.12": "v1.12.0"}
+func (img *RenamedImage) aliasTags(tags []string) map[string]string {
+	aliases := map[string]string{}
+	versions := map[string]*semver.Version{}
+	for _, t := range img.templates().aliasTags {
+		for _, tag := range tags {
+			version, err := semver.NewVersion(img.tagData(tag).Version)
+			if err != nil || version.Prerelease() != "" {
+				continue
+			}
+			rendered, err := img.executeTagTemplate(t, tag)
+			if err != nil {
+				logrus.Warnf("image %q: skipping alias: %v", img.Image, err)
+				continue
+			}
+			alias, err := normalizeTag(rendered)
+			if err != nil {
+				logrus.Warnf("image %q: skipping alias of %q: %v", img.Image, tag, err)
+				continue
+			}
+			if current, ok := versions[alias]; !ok || version.GreaterThan(current) {
+				aliases[alias] = tag
+				versions[alias] = version
+			}
+		}
+	}
+	for _, tag := range tags {
+		if destinationTag := img.destinationTag(tag); aliases[destinationTag] != "" {
+			logrus.Warnf("image %q: skipping alias %q, which is also the destination tag of %q", img.Image, destinationTag, tag)
+			delete(aliases, destinationTag)
+		}
+	}
+	return aliases
+}
+
+// planAliases adds copies pointing alias tags at the source tags they alias.
+// An alias is copied to every destination if its source tag is copied, and
+// otherwise only to destinations it is missing in, or, with --compare-digests,
+// in which it points to another digest. presentTags are tags present in each
+// of imageDestinations, nil if existing tags are not skipped.
+func (img *RenamedImage) planAliases(plan *imagePlan, aliases map[string]string, tags []string, imageDestinations []destination, presentTags [][]string) {
+	aliasTags := maps.Keys(aliases)
+	slices.Sort(aliasTags)
+	sourceDigests := map[string]string{}
+	for _, alias := range aliasTags {
+		tag := aliases[alias]
+		aliasDestinations := imageDestinations
+		if flagSkipExistingTags && !slices.Contains(tags, tag) {
+			aliasDestinations = nil
+			for i, d := range imageDestinations {
+				missing := !slices.Contains(presentTags[i], alias)
+				if !missing && flagCompareDigests {
+					moved := findMovedTags(img.Image, []string{tag}, d.Repository(img.repositoryName()), func(string) string { return alias }, img.selectedPlatforms(), sourceDigests)
+					missing = len(moved) > 0
+				}
+				if missing {
+					aliasDestinations = append(aliasDestinations, d)
+				}
+			}
+		}
+		if len(aliasDestinations) == 0 {
+			continue
+		}
+		plan.Add(fmt.Sprintf("%s:%s", img.Image, tag), aliasDestinations, img.repositoryName(), alias, true, img.selectedPlatforms())
+	}
+}
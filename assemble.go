@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// imageIndex is used to marshal OCI image indexes assembled from
+// per-architecture images.
+type imageIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+// imageConfig is used to unmarshal the platform of an image from its config.
+type imageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	OSVersion    string `json:"os.version,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// groupPattern returns the pattern, whose first group is the tag of the
+// index assembled from per-architecture tags. It is Filter if set, and
+// TagOrPattern otherwise.
+func (img *RenamedImage) groupPattern() string {
+	if img.Filter != "" {
+		return img.Filter
+	}
+	return img.TagOrPattern
+}
+
+// validateAssembleIndex returns an error if per-architecture tags of the image
+// cannot be grouped.
+func (img *RenamedImage) validateAssembleIndex() error {
+	if !img.AssembleIndex {
+		return nil
+	}
+	if img.SHA != "" {
+		return fmt.Errorf("%q cannot be used with %q", "assemble_index", "sha")
+	}
+	if pattern := img.templates().groups; pattern == nil || pattern.NumSubexp() == 0 {
+		return fmt.Errorf("%q requires a group in %q or %q, matching the tag of the index", "assemble_index", "filter", "tag_or_pattern")
+	}
+	return nil
+}
+
+// groupTags returns a map of index tag -> per-architecture tags, grouped by
+// the first group of the image's filter or pattern. Tags without the group are
+// not grouped.
+// Example: ["1.0-amd64", "1.0-arm64"] -> {"1.0": ["1.0-amd64", "1.0-arm64"]}
+func (img *RenamedImage) groupTags(tags []string) map[string][]string {
+	groups := map[string][]string{}
+	pattern := img.templates().groups
+	if pattern == nil {
+		return groups
+	}
+	for _, tag := range tags {
+		matches := pattern.FindStringSubmatch(tag)
+		if len(matches) < 2 || matches[1] == "" {
+			continue
+		}
+		groups[matches[1]] = append(groups[matches[1]], tag)
+	}
+	for _, group := range groups {
+		slices.Sort(group)
+	}
+	return groups
+}
+
+// planIndexes adds copies assembling an index for every group of matched tags,
+// whose per-architecture tags are copied, or whose index tag is missing in any
+// destination. presentTags are tags present in every destination, nil if
+// existing tags are not skipped.
+func (img *RenamedImage) planIndexes(plan *imagePlan, tags []string, imageDestinations []destination, presentTags [][]string) {
+	groups := img.groupTags(plan.MatchedTags)
+	indexTags := maps.Keys(groups)
+	slices.Sort(indexTags)
+	for _, indexTag := range indexTags {
+		members := groups[indexTag]
+		needed := !flagSkipExistingTags || len(img.FindMissingTags([]string{indexTag}, presentTags...)) > 0
+		for _, tag := range members {
+			needed = needed || slices.Contains(tags, tag)
+		}
+		if !needed {
+			continue
+		}
+		var sources []string
+		for _, tag := range members {
+			sources = append(sources, fmt.Sprintf("%s:%s", img.Image, tag))
+		}
+		// An index, whose tag cannot be rendered, fails in every destination,
+		// so it is reported instead of silently missing.
+		tag, err := img.renderDestinationTag(indexTag)
+		var copyErr string
+		if err != nil {
+			tag = indexTag
+			copyErr = fmt.Sprintf("error rendering tag of index %q: %v", indexTag, err)
+		}
+		for _, d := range imageDestinations {
+			plan.Copies = append(plan.Copies, plannedCopy{
+				Source:      img.Image,
+				Sources:     sources,
+				Destination: d.Name,
+				Target:      fmt.Sprintf("%s:%s", d.Repository(img.repositoryName()), tag),
+				Tag:         tag,
+				Mutable:     img.IsMutableTag(indexTag),
+				Platforms:   img.selectedPlatforms(),
+				Error:       copyErr,
+			})
+		}
+	}
+}
+
+// assembleImage is a helper function used to push an index of per-architecture
+// images to destination. Like copyImage, it retries failed attempts.
+func assembleImage(ctx context.Context, image string, sources []string, destination string, platforms []string) copyResult {
+	result := copyResult{
+		Source:      image,
+		Destination: destination,
+	}
+	start := time.Now()
+	logrus.Debugf("assembling %q from %s", destination, strings.Join(sources, ", "))
+	result.Digest, result.Err = assembleImageWithRetries(ctx, sources, destination, platforms)
+	result.Duration = time.Since(start)
+	if result.Err != nil {
+		logrus.Errorf("error assembling %q: %v", destination, result.Err)
+		return result
+	}
+	logrus.Debugf("assembled %q", destination)
+	return result
+}
+
+// assembleImageWithRetries assembles the index using defaultCopier, retrying
+// like copyImageWithRetries.
+func assembleImageWithRetries(ctx context.Context, sources []string, destination string, platforms []string) (string, error) {
+	var sourceRefs []imageReference
+	for _, source := range sources {
+		ref, err := parseReference(source)
+		if err != nil {
+			return "", err
+		}
+		sourceRefs = append(sourceRefs, ref)
+	}
+	destinationRef, err := parseReference(destination)
+	if err != nil {
+		return "", err
+	}
+
+	var digest string
+	for attempt := 0; attempt < 3; attempt++ {
+		digest, err = defaultCopier.Assemble(ctx, sourceRefs, destinationRef, platforms)
+		if err == nil {
+			return digest, nil
+		}
+		if errors.Is(err, errUnsupportedManifest) || ctx.Err() != nil {
+			break
+		}
+		logrus.WithField("attempt", attempt+1).Warnf("error assembling %q: %v", destination, err)
+		if attempt < 2 {
+			_ = sleep(ctx, backoffDelay(attempt))
+		}
+	}
+	return digest, err
+}
+
+// Assemble copies the per-architecture images to the destination repository
+// by digest, and pushes an OCI index of them to destination. Platforms of
+// single images are read from their configs, indexes contribute all their
+// manifests. The index is filtered by platforms, like in Copy. It returns the
+// digest of the pushed index.
+func (c *imageCopier) Assemble(ctx context.Context, sources []imageReference, destination imageReference, platforms []string) (string, error) {
+	index := imageIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	// origins is a map of platform -> source it was found in.
+	origins := map[string]imageReference{}
+	for _, source := range sources {
+		b, mediaType, digest, err := c.client.GetManifest(ctx, source)
+		if err != nil {
+			return "", fmt.Errorf("error getting manifest of %q: %w", source, err)
+		}
+		childDestination := imageReference{Registry: destination.Registry, Repository: destination.Repository, Digest: digest}
+		if err := c.copyManifest(ctx, source, childDestination, b, mediaType); err != nil {
+			return "", err
+		}
+
+		var descriptors []descriptor
+		if isIndex(mediaType) {
+			m, err := parseManifest(b)
+			if err != nil {
+				return "", fmt.Errorf("error parsing manifest of %q: %w", source, err)
+			}
+			descriptors = m.Manifests
+		} else {
+			p, err := c.platformOf(ctx, source, b)
+			if err != nil {
+				return "", err
+			}
+			descriptors = []descriptor{{MediaType: mediaType, Digest: digest, Size: int64(len(b)), Platform: p}}
+		}
+		for _, d := range descriptors {
+			if d.Platform != nil && d.Annotations[attestationReferenceAnnotation] == "" {
+				if other, ok := origins[d.Platform.String()]; ok {
+					return "", fmt.Errorf("platform %s is in both %q and %q", d.Platform, other, source)
+				}
+				origins[d.Platform.String()] = source
+			}
+			index.Manifests = append(index.Manifests, d)
+		}
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling index: %w", err)
+	}
+	b, err = selectPlatforms(destination, b, mediaTypeOCIIndex, platforms)
+	if err != nil {
+		return "", err
+	}
+	if err := c.client.PutManifest(ctx, destination, mediaTypeOCIIndex, b); err != nil {
+		return "", fmt.Errorf("error pushing manifest to %q: %w", destination, err)
+	}
+	return digestOf(b), nil
+}
+
+// platformOf returns the platform of the image manifest b, read from its
+// config.
+func (c *imageCopier) platformOf(ctx context.Context, source imageReference, b []byte) (*platform, error) {
+	m, err := parseManifest(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest of %q: %w", source, err)
+	}
+	if m.Config == nil {
+		return nil, fmt.Errorf("manifest of %q has no config", source)
+	}
+	body, err := c.client.GetBlob(ctx, source, m.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("error getting config of %q: %w", source, err)
+	}
+	defer body.Close()
+	configB, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config of %q: %w", source, err)
+	}
+	config := imageConfig{}
+	if err := json.Unmarshal(configB, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshaling config of %q: %w", source, err)
+	}
+	if config.OS == "" || config.Architecture == "" {
+		return nil, fmt.Errorf("config of %q has no platform", source)
+	}
+	return &platform{
+		Architecture: config.Architecture,
+		OS:           config.OS,
+		OSVersion:    config.OSVersion,
+		Variant:      config.Variant,
+	}, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanIndexesRenderError(t *testing.T) {
+	img := RenamedImage{
+		Image:          "cloudflare/cloudflared",
+		TagOrPattern:   "^(.+)-(amd64|arm64)$",
+		AssembleIndex:  true,
+		DestinationTag: "{{index .Groups 5}}",
+	}
+	tags := []string{"2024.1.0-amd64", "2024.1.0-arm64"}
+	plan := imagePlan{Image: img.Image, MatchedTags: tags}
+	img.planIndexes(&plan, tags, destinations, nil)
+
+	if len(plan.Copies) != len(destinations) {
+		t.Fatalf("got %d copies, expected a failed copy per destination", len(plan.Copies))
+	}
+	result := plan.Execute()
+	failed := result.Failed()
+	if len(failed) != len(destinations) {
+		t.Fatalf("got %d failed copies, expected %d", len(failed), len(destinations))
+	}
+	for _, f := range failed {
+		if !strings.Contains(f.Err.Error(), `error rendering tag of index "2024.1.0"`) {
+			t.Errorf("unexpected error: %v", f.Err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var copyCheckpoint = &checkpointFile{}
+
+// checkpointFile records every completed copy and image definition of
+// `retagger run`, one JSON object per line, so a run interrupted e.g. by a CI
+// timeout can be resumed. It is truncated once the run completes, even if
+// copies failed, so only interrupted runs are resumed. Failed copies of
+// completed runs are retried with --retry-failed.
+type checkpointFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+type checkpointEntry struct {
+	// Image is the key of an image definition, all copies of which
+	// completed successfully. Source and Target are empty then.
+	Image       string    `json:"image,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Digest      string    `json:"digest,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// Open opens the file at path for appending, creating it if needed. A line
+// cut off by an interrupted run is removed, so the next entry starts on a new
+// line instead of being glued to it.
+func (c *checkpointFile) Open(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening checkpoint %q: %w", path, err)
+	}
+	if err := truncatePartialLine(f); err != nil {
+		f.Close()
+		return fmt.Errorf("error opening checkpoint %q: %w", path, err)
+	}
+	c.path = path
+	c.file = f
+	return nil
+}
+
+// truncatePartialLine truncates the file after its last newline.
+func truncatePartialLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			size = start + int64(i) + 1
+			break
+		}
+		end = start
+		size = 0
+	}
+	if size == info.Size() {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// Record appends the copy result. It does nothing if the checkpoint was not
+// opened.
+func (c *checkpointFile) Record(result copyResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	entry := checkpointEntry{
+		Source:      result.Source,
+		Target:      result.Destination,
+		Digest:      result.Digest,
+		CompletedAt: time.Now().UTC(),
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+	return c.write(entry)
+}
+
+// RecordImage appends the key of an image definition, all copies of which
+// completed successfully, so resuming skips it without planning it again. It
+// does nothing if the checkpoint was not opened.
+func (c *checkpointFile) RecordImage(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	return c.write(checkpointEntry{Image: key, CompletedAt: time.Now().UTC()})
+}
+
+// write appends the entry as a line. c.mu must be held.
+func (c *checkpointFile) write(entry checkpointEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling checkpoint entry: %w", err)
+	}
+	if _, err := c.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing checkpoint %q: %w", c.path, err)
+	}
+	return nil
+}
+
+// Complete truncates the checkpoint, since there is nothing left to resume.
+func (c *checkpointFile) Complete() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	if err := c.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating checkpoint %q: %w", c.path, err)
+	}
+	return nil
+}
+
+// resumedRun is what an interrupted run completed according to its
+// checkpoint.
+type resumedRun struct {
+	// images is a set of keys of image definitions, all copies of which
+	// completed.
+	images map[string]bool
+	// copies is a set of completed copies as "<source> <target>" strings.
+	copies map[string]bool
+}
+
+// loadCheckpoint returns image definitions and copies completed successfully
+// according to the checkpoint at path. A missing file means nothing was
+// completed.
+func loadCheckpoint(path string) (resumedRun, error) {
+	completed := resumedRun{
+		images: map[string]bool{},
+		copies: map[string]bool{},
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return completed, nil
+	} else if err != nil {
+		return completed, fmt.Errorf("error reading checkpoint %q: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := checkpointEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line is incomplete if the run was killed while
+			// writing it. The copy is simply performed again.
+			logrus.Warnf("skipping line %d of checkpoint %q: %v", line, path, err)
+			continue
+		}
+		switch {
+		case entry.Image != "":
+			completed.images[entry.Image] = true
+		case entry.Error == "":
+			completed.copies[copyKey(entry.Source, entry.Target)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return completed, fmt.Errorf("error reading checkpoint %q: %w", path, err)
+	}
+	return completed, nil
+}
+
+// runFailures are failures of a previous run, read from its JSON report.
+type runFailures struct {
+	// images is a set of keys of image definitions, which failed or have
+	// failed copies. Image names are used for reports without keys.
+	images map[string]bool
+	// failedImages is a set of keys of image definitions, which could not be
+	// processed at all, so all their copies are retried.
+	failedImages map[string]bool
+	// copies is a set of failed copies as "<source> <target>" strings.
+	copies map[string]bool
+}
+
+// loadRunFailures reads failures from a JSON report of `retagger run`.
+func loadRunFailures(path string) (runFailures, error) {
+	failures := runFailures{
+		images:       map[string]bool{},
+		failedImages: map[string]bool{},
+		copies:       map[string]bool{},
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return failures, fmt.Errorf("error reading report %q: %w", path, err)
+	}
+	r := report{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return failures, fmt.Errorf("error unmarshaling report %q: %w", path, err)
+	}
+	if r.Command != "run" {
+		return failures, fmt.Errorf("report %q is a report of %q, not of %q", path, r.Command, "run")
+	}
+	for _, image := range r.Images {
+		key := image.Key
+		if key == "" {
+			key = image.Image
+		}
+		if image.Error != "" {
+			failures.images[key] = true
+			failures.failedImages[key] = true
+		}
+		for _, c := range image.Copies {
+			if c.Status == copyStatusFailed {
+				failures.images[key] = true
+				failures.copies[copyKey(c.Source, c.Target)] = true
+			}
+		}
+	}
+	return failures, nil
+}
+
+// Includes returns true if the image definition failed in the previous run.
+func (f runFailures) Includes(img RenamedImage) bool {
+	return f.images[img.Key()] || f.images[img.Image]
+}
+
+// Retried returns true if the copy has to be retried. All copies of image
+// definitions, which could not be processed at all, are retried.
+func (f runFailures) Retried(img RenamedImage, c plannedCopy) bool {
+	if f.failedImages[img.Key()] || f.failedImages[img.Image] {
+		return true
+	}
+	return f.copies[copyKey(c.Source, c.Target)]
+}
+
+func copyKey(source, target string) string {
+	return source + " " + target
+}
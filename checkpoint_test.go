@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+	checkpoint := &checkpointFile{}
+	if err := checkpoint.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	records := []copyResult{
+		{Source: "alpine:3.19", Destination: "gsoci.azurecr.io/giantswarm/alpine:3.19", Digest: "sha256:a"},
+		{Source: "alpine:3.20", Destination: "gsoci.azurecr.io/giantswarm/alpine:3.20", Err: errors.New("timeout")},
+	}
+	for _, r := range records {
+		if err := checkpoint.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkpoint.RecordImage("busybox-key"); err != nil {
+		t.Fatal(err)
+	}
+	// A line cut off by an interrupted run.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"source":"alpine:3.21","tar`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	completed, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !completed.copies[copyKey(records[0].Source, records[0].Destination)] {
+		t.Error("expected successful copy to be completed")
+	}
+	if completed.copies[copyKey(records[1].Source, records[1].Destination)] {
+		t.Error("expected failed copy not to be completed")
+	}
+	if len(completed.copies) != 1 {
+		t.Errorf("got %d completed copies, expected 1", len(completed.copies))
+	}
+	if !completed.images["busybox-key"] || len(completed.images) != 1 {
+		t.Errorf("got completed images %v, expected only busybox-key", completed.images)
+	}
+
+	if err := checkpoint.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	completed, err = loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed.copies) != 0 || len(completed.images) != 0 {
+		t.Errorf("expected completed checkpoint to be empty, got %v", completed)
+	}
+}
+
+func TestRenamedImageKeyOptions(t *testing.T) {
+	base := RenamedImage{Image: "quay.io/cilium/cilium", Semver: ">= 1.15"}
+	variants := []RenamedImage{base, base, base, base, base, base}
+	variants[1].DestinationTag = "{{.Tag}}-fips"
+	variants[2].Destinations = []string{"azure"}
+	variants[3].Platforms = []string{"linux/amd64"}
+	variants[4].AliasTags = []string{"{{.Major}}"}
+	variants[5].AssembleIndex = true
+
+	// Entries differing only in options not affecting listed tags are still
+	// different definitions, which are completed separately when resuming.
+	keys := map[string]bool{}
+	for _, img := range variants {
+		keys[img.Key()] = true
+	}
+	if len(keys) != len(variants) {
+		t.Errorf("got %d distinct keys of %d entries, expected all to differ", len(keys), len(variants))
+	}
+	if again := base; again.Key() != variants[0].Key() {
+		t.Errorf("got key %q for an equal entry, expected %q", again.Key(), variants[0].Key())
+	}
+}
+
+func TestRenamedImageShardKey(t *testing.T) {
+	base := RenamedImage{Image: "quay.io/cilium/cilium", Semver: ">= 1.15"}
+	edited := base
+	edited.Semver = ">= 1.16"
+	edited.DestinationTag = "{{.Tag}}-fips"
+	edited.Platforms = []string{"linux/amd64"}
+	renamed := base
+	renamed.OverrideRepoName = "cilium-fips"
+
+	// Edited entries keep their shard and weight, entries copied to other
+	// repositories are sharded separately.
+	if base.ShardKey() != edited.ShardKey() {
+		t.Errorf("got shard key %q of an edited entry, expected %q", edited.ShardKey(), base.ShardKey())
+	}
+	if base.ShardKey() == renamed.ShardKey() {
+		t.Errorf("got equal shard key %q for another repository", renamed.ShardKey())
+	}
+
+	keys := []string{base.ShardKey(), renamed.ShardKey(), "docker.io/library/alpine alpine", edited.ShardKey()}
+	shards := assignShards(keys, nil, 3)
+	if shards[0] != shards[3] {
+		t.Errorf("got shards %v, expected entries with equal shard keys on the same shard", shards)
+	}
+}
+
+func TestCheckpointOpenPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+	content := `{"image":"busybox-key","completedAt":"2024-01-01T00:00:00Z"}` + "\n" + `{"source":"alpine:3.21","tar`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resuming appends to the checkpoint of the interrupted run.
+	checkpoint := &checkpointFile{}
+	if err := checkpoint.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	record := copyResult{Source: "alpine:3.21", Destination: "gsoci.azurecr.io/giantswarm/alpine:3.21", Digest: "sha256:a"}
+	if err := checkpoint.Record(record); err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !completed.images["busybox-key"] {
+		t.Error("expected complete lines to be kept")
+	}
+	if !completed.copies[copyKey(record.Source, record.Destination)] {
+		t.Error("expected copy recorded after the cut off line to be completed")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// repositoryUse records that an image entry pushes an upstream repository to
+// a destination repository.
+type repositoryUse struct {
+	// Target is the full destination repository.
+	// Example: "gsoci.azurecr.io/giantswarm/operator"
+	Target string
+	// Destination is the destination name.
+	// Example: "azure"
+	Destination string
+	// Upstream is the full source repository.
+	// Example: "quay.io/cilium/operator"
+	Upstream string
+	// AllowCollision is set if the entry explicitly allows other upstream
+	// repositories to be pushed to the same Target.
+	AllowCollision bool
+
+	File   string
+	Line   int
+	Column int
+}
+
+// addUses records uses of all destination repositories the upstream image is
+// pushed to under the given repository name.
+func (v *fileValidator) addUses(node *yaml.Node, image, repositoryName string, imageDestinations []destination, allowCollision bool) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return // Reported by the caller.
+	}
+	for _, d := range imageDestinations {
+		use := repositoryUse{
+			Target:         d.Repository(repositoryName),
+			Destination:    d.Name,
+			Upstream:       ref.Name(),
+			AllowCollision: allowCollision,
+			File:           v.file,
+		}
+		if node != nil {
+			use.Line = node.Line
+			use.Column = node.Column
+		}
+		v.uses = append(v.uses, use)
+	}
+}
+
+// findCollisions reports destination repositories, which two or more different
+// upstream repositories are pushed to, e.g. "quay.io/cilium/operator" and
+// "ghcr.io/foo/operator" both becoming "giantswarm/operator". Tags of one
+// would silently overwrite tags of the other.
+//
+// A collision is allowed only if every entry involved in it sets
+// allow_collision (renamed files) or allow-collision (skopeo image-options).
+func findCollisions(uses []repositoryUse) []validationProblem {
+	usesPerTarget := map[string][]repositoryUse{}
+	for _, u := range uses {
+		usesPerTarget[u.Target] = append(usesPerTarget[u.Target], u)
+	}
+
+	// Collisions of an entry are usually the same in every destination, so
+	// they are reported once per entry, listing all affected destinations.
+	type collision struct {
+		use    repositoryUse
+		others string
+	}
+	var collisions []collision
+	destinationsPerCollision := map[collision][]string{}
+	for _, target := range sortedKeys(usesPerTarget) {
+		targetUses := usesPerTarget[target]
+
+		upstreams := map[string]bool{}
+		allowed := true
+		for _, u := range targetUses {
+			upstreams[u.Upstream] = true
+			allowed = allowed && u.AllowCollision
+		}
+		if len(upstreams) < 2 || allowed {
+			continue
+		}
+
+		for _, u := range targetUses {
+			if u.AllowCollision {
+				continue
+			}
+			var others []string
+			for _, o := range targetUses {
+				if o.Upstream != u.Upstream {
+					others = append(others, fmt.Sprintf("%s (%s:%d)", o.Upstream, o.File, o.Line))
+				}
+			}
+			c := collision{others: strings.Join(others, ", ")}
+			c.use = u
+			c.use.Target, c.use.Destination = "", ""
+			if _, ok := destinationsPerCollision[c]; !ok {
+				collisions = append(collisions, c)
+			}
+			destinationsPerCollision[c] = append(destinationsPerCollision[c], fmt.Sprintf("%s (%s)", target, u.Destination))
+		}
+	}
+
+	var problems []validationProblem
+	for _, c := range collisions {
+		problems = append(problems, validationProblem{
+			File:    c.use.File,
+			Line:    c.use.Line,
+			Column:  c.use.Column,
+			Message: fmt.Sprintf("%s is pushed to %s, which is also used by %s; use a different repository name or allow the collision", c.use.Upstream, strings.Join(destinationsPerCollision[c], ", "), c.others),
+		})
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		return problems[i].Line < problems[j].Line
+	})
+	return problems
+}
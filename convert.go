@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// convertedImage is a renamed image converted from an entry of a skopeo or
+// renamed file.
+type convertedImage struct {
+	image RenamedImage
+	// node is the original entry of a renamed file, which is kept with its
+	// comments and key order if it needs no conversion.
+	node *yaml.Node
+	// comment is written above the converted entry, e.g. comments of the
+	// image in the skopeo file.
+	comment string
+}
+
+// Node returns the YAML node the image is written as.
+func (c convertedImage) Node() (*yaml.Node, error) {
+	if c.node != nil {
+		return c.node, nil
+	}
+	node := &yaml.Node{}
+	if err := node.Encode(c.image); err != nil {
+		return nil, err
+	}
+	node.HeadComment = c.comment
+	return node, nil
+}
+
+// commandConvert is invoked when `retagger convert` is called.
+//
+// It converts skopeo and renamed files in images/ or the given paths to a
+// single list of renamed images, printed to stdout. `retagger run` copies the
+// same tags to the same repositories with it, as `skopeo sync` does with
+// skopeo files. Deprecated options of renamed images
+// are replaced by destination_tag. Registry settings of skopeo files are
+// added to --registries-file, since they apply to the whole registry.
+func commandConvert(paths []string) {
+	if len(paths) == 0 {
+		paths = []string{"images"}
+	}
+	files, err := imageFiles(paths)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	settings := map[string]registrySettings{}
+	if flagRegistriesFile != "" {
+		settings, err = loadRegistrySettings(flagRegistriesFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			settings = map[string]registrySettings{}
+		} else if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	existingSettings := len(settings)
+
+	var convertedImages []convertedImage
+	for _, file := range files {
+		var converted []convertedImage
+		switch imageFileKind(file) {
+		case "renamed":
+			converted, err = convertRenamedFile(file)
+		case "skopeo":
+			converted, err = convertSkopeoFile(file, settings)
+		default:
+			err = fmt.Errorf("unknown file type, expected %s*.yaml or %s*.yaml", renamedFilePrefix, skopeoFilePrefix)
+		}
+		if err != nil {
+			logrus.Fatalf("error converting %q: %v", file, err)
+		}
+		logrus.Infof("Converted %d images of %q", len(converted), file)
+		convertedImages = append(convertedImages, converted...)
+	}
+
+	sequence := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, c := range convertedImages {
+		if err := c.image.Validate(); err != nil {
+			logrus.Fatalf("converted image %q is invalid: %v", c.image.Image, err)
+		}
+		node, err := c.Node()
+		if err != nil {
+			logrus.Fatalf("error marshaling image %q: %v", c.image.Image, err)
+		}
+		sequence.Content = append(sequence.Content, node)
+	}
+
+	if len(settings) > existingSettings {
+		if flagRegistriesFile == "" {
+			logrus.Fatalf("skopeo files set tls-verify, cert-dir, or credentials of registries, use %q to convert them", "registries-file")
+		}
+		if err := writeRegistrySettings(flagRegistriesFile, settings); err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Saved settings of %d registries to %q", len(settings), flagRegistriesFile)
+	}
+
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(sequence); err != nil {
+		logrus.Fatalf("error marshaling images: %v", err)
+	}
+	if _, err := os.Stdout.Write(b.Bytes()); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Converted %d files to %d images", len(files), len(convertedImages))
+}
+
+// convertRenamedFile returns renamed images of the file, with add_tag_suffix
+// and strip_semver_prefix replaced by the equivalent destination_tag. Other
+// entries are kept as they are.
+func convertRenamedFile(path string) ([]convertedImage, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	var renamedImages []RenamedImage
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&renamedImages); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error unmarshaling file: %w", err)
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return nil, fmt.Errorf("error unmarshaling file: %w", err)
+	}
+	var items []*yaml.Node
+	if len(doc.Content) > 0 {
+		items = doc.Content[0].Content
+	}
+
+	converted := make([]convertedImage, len(renamedImages))
+	for i, img := range renamedImages {
+		if img.AddTagSuffix == "" && !img.StripSemverPrefix {
+			converted[i] = convertedImage{image: img, node: items[i]}
+			continue
+		}
+		if img.DestinationTag == "" {
+			img.DestinationTag = img.destinationTagTemplate()
+		}
+		img.AddTagSuffix = ""
+		img.StripSemverPrefix = false
+		converted[i] = convertedImage{image: img, comment: items[i].HeadComment}
+	}
+	return converted, nil
+}
+
+// convertSkopeoFile returns renamed images copying the same tags as the
+// skopeo file. Every image list of an image results in a separate entry:
+// `images` in tags, or tag_or_pattern ".*" for an empty list,
+// `images-by-tag-regex` in tag_or_pattern, and `images-by-semver` in semver.
+// Image options and comments of images are kept. Registry settings are added
+// to settings, failing if they conflict. Digests cannot be converted, since
+// skopeo pushes them untagged.
+// Example: "quay.io: {images-by-semver: {cilium/cilium: >= 1.15}}" ->
+// [{image: quay.io/cilium/cilium, semver: >= 1.15}]
+func convertSkopeoFile(path string, settings map[string]registrySettings) ([]convertedImage, error) {
+	file, doc, err := readSkopeoFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var converted []convertedImage
+	registryNames := maps.Keys(file)
+	slices.Sort(registryNames)
+	for _, registryName := range registryNames {
+		r := file[registryName]
+		if err := addRegistrySettings(settings, registryName, r.settings()); err != nil {
+			return nil, err
+		}
+		comments := skopeoImageComments(valueNode(doc.Content[0], registryName))
+		names := append(maps.Keys(r.Images), maps.Keys(r.ImagesByTagRegex)...)
+		names = append(names, maps.Keys(r.ImagesBySemver)...)
+		slices.Sort(names)
+		for _, name := range slices.Compact(names) {
+			options := r.ImageOptions[name]
+			base := RenamedImage{
+				Image:               registryName + "/" + name,
+				Destinations:        options.Destinations,
+				ExcludeDestinations: options.ExcludeDestinations,
+				AllowCollision:      options.AllowCollision,
+				MutableTags:         options.MutableTags,
+				Platforms:           options.Platforms,
+			}
+			// Comments are written above the first entry of the image.
+			comment := comments[name]
+			add := func(img RenamedImage) {
+				converted = append(converted, convertedImage{image: img, comment: comment})
+				comment = ""
+			}
+			if tags, ok := r.Images[name]; ok {
+				img := base
+				img.Tags = tags
+				if len(tags) == 0 {
+					// An empty list syncs all tags.
+					img.TagOrPattern = ".*"
+				}
+				for _, tag := range tags {
+					if strings.Contains(tag, ":") {
+						return nil, fmt.Errorf("image %q: digest %q cannot be converted, skopeo pushes it untagged", base.Image, tag)
+					}
+				}
+				add(img)
+			}
+			if pattern, ok := r.ImagesByTagRegex[name]; ok {
+				img := base
+				img.TagOrPattern = pattern
+				add(img)
+			}
+			if constraint, ok := r.ImagesBySemver[name]; ok {
+				img := base
+				img.Semver = constraint
+				add(img)
+			}
+		}
+	}
+	return converted, nil
+}
+
+// skopeoImageComments returns a map of image name -> comments of the image in
+// the image lists and image-options of the registry section.
+func skopeoImageComments(section *yaml.Node) map[string]string {
+	comments := map[string]string{}
+	for _, list := range []string{"images", "images-by-tag-regex", "images-by-semver", "image-options"} {
+		listNode := valueNode(section, list)
+		if listNode == section {
+			continue
+		}
+		for i := 0; i+1 < len(listNode.Content); i += 2 {
+			key, value := listNode.Content[i], listNode.Content[i+1]
+			lines := []string{key.HeadComment, key.LineComment, key.FootComment}
+			if value.Kind == yaml.ScalarNode {
+				lines = append(lines, value.LineComment)
+			}
+			for _, line := range lines {
+				if line == "" {
+					continue
+				}
+				if comments[key.Value] != "" {
+					comments[key.Value] += "\n"
+				}
+				comments[key.Value] += line
+			}
+		}
+	}
+	return comments
+}
+
+// writeRegistrySettings writes settings to file in the --registries-file
+// format. The file can contain credentials, so it is only readable by the
+// user.
+func writeRegistrySettings(file string, settings map[string]registrySettings) error {
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(settings); err != nil {
+		return fmt.Errorf("error marshaling registry settings: %w", err)
+	}
+	if err := os.WriteFile(file, b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing %q: %w", file, err)
+	}
+	return nil
+}
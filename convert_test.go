@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertSkopeoFile(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "skopeo-a.yaml")
+	second := filepath.Join(dir, "skopeo-b.yaml")
+	files := map[string]string{
+		first: `registry.example.com:
+  tls-verify: false
+  images:
+    # Used by app.
+    redis:
+      - "6.0"
+  images-by-semver:
+    redis: ">= 7.0"
+    alpine: ">= 3.17" # Base image.
+  image-options:
+    redis:
+      destinations: ["azure"]
+`,
+		second: `registry.example.com:
+  tls-verify: true
+  images:
+    busybox: []
+`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := map[string]registrySettings{}
+	converted, err := convertSkopeoFile(first, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range converted {
+		got = append(got, c.image.Key()+" "+strings.Join(c.image.Destinations, ",")+" "+c.comment)
+		if c.image.TagOrPattern == "" && c.image.Semver == "" && len(c.image.Tags) == 0 {
+			t.Errorf("image %q copies no tags", c.image.Image)
+		}
+	}
+	expected := []string{
+		(&RenamedImage{Image: "registry.example.com/alpine", Semver: ">= 3.17"}).Key() + "  # Base image.",
+		(&RenamedImage{Image: "registry.example.com/redis", Tags: []string{"6.0"}, Destinations: []string{"azure"}}).Key() + " azure # Used by app.",
+		(&RenamedImage{Image: "registry.example.com/redis", Semver: ">= 7.0", Destinations: []string{"azure"}}).Key() + " azure ",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got images:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+	if s := settings["registry.example.com"]; s.TLSVerify == nil || *s.TLSVerify {
+		t.Errorf("expected tls-verify of the registry to be kept, got %+v", s)
+	}
+
+	if _, err := convertSkopeoFile(second, settings); err == nil || !strings.Contains(err.Error(), "conflict") {
+		t.Errorf("expected conflicting registry settings to fail, got %v", err)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	// Docker schema 1 manifests are deprecated and reference layers by
+	// digests of their uncompressed content, so they cannot be copied as is.
+	// docs: https://distribution.github.io/distribution/spec/deprecated-schema-v1/
+	mediaTypeDockerManifestSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeDockerManifestSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// errUnsupportedManifest is returned for manifests retagger is not able to
+// copy. Retrying does not help, so copies failing with it are not retried.
+var errUnsupportedManifest = errors.New("unsupported manifest")
+
+// errDiskUsageExceeded is returned for blobs, which are not downloaded since
+// they would exceed the disk usage limit of the copier.
+var errDiskUsageExceeded = errors.New("disk usage limit exceeded")
+
+var defaultCopier = newImageCopier(defaultRegistryClient, path.Join(temporaryWorkingDir, "blobs"))
+
+// manifestMediaTypes are the manifest formats retagger is able to copy.
+var manifestMediaTypes = []string{
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+}
+
+// manifest is used to unmarshal image manifests and indexes (manifest lists).
+// Only the fields needed to walk the image graph are defined. The original
+// bytes are always pushed, so no information is lost.
+type manifest struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Config    *descriptor  `json:"config,omitempty"`
+	Layers    []descriptor `json:"layers,omitempty"`
+	Manifests []descriptor `json:"manifests,omitempty"`
+}
+
+// descriptor points to a blob or a manifest.
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	URLs        []string          `json:"urls,omitempty"`
+	Platform    *platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// platform describes the OS and architecture an image is built for.
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	OSVersion    string `json:"os.version,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func parseManifest(b []byte) (manifest, error) {
+	m := manifest{}
+	err := json.Unmarshal(b, &m)
+	return m, err
+}
+
+// isIndex returns true for manifest lists and OCI indexes.
+func isIndex(mediaType string) bool {
+	return mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerManifestList
+}
+
+// isForeignLayer returns true for layers which must not be pushed to other
+// registries, like Windows base layers. skopeo skips them as well.
+func isForeignLayer(d descriptor) bool {
+	return len(d.URLs) > 0 && (strings.Contains(d.MediaType, "foreign") || strings.Contains(d.MediaType, "nondistributable"))
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// imageCopier copies images between registries. Blobs are downloaded from the
+// source only once and kept on disk until Release is called for every
+// repository using them, so copying the same image to several destinations
+// does not pull it from upstream repeatedly. Blobs not fitting in maxDiskUsage
+// are streamed from the source to every destination instead.
+type imageCopier struct {
+	client *registryClient
+	dir    string
+	// maxDiskUsage is the maximum number of bytes of blobs kept on disk at
+	// once. 0 means no limit.
+	maxDiskUsage int64
+
+	mu sync.Mutex
+	// diskUsage is the number of bytes of blobs in downloads.
+	diskUsage int64
+	// downloads is a map of digest -> blob downloaded to dir.
+	downloads map[string]*blobDownload
+	// mountSources is a map of registry -> digest -> repository known to
+	// contain the blob. It is used for cross-repository blob mounts.
+	mountSources map[string]map[string]string
+}
+
+type blobDownload struct {
+	done chan struct{}
+	path string
+	size int64
+	err  error
+	// repositories are source repositories the blob was downloaded for.
+	repositories map[string]bool
+}
+
+func newImageCopier(client *registryClient, dir string) *imageCopier {
+	return &imageCopier{
+		client:       client,
+		dir:          dir,
+		downloads:    map[string]*blobDownload{},
+		mountSources: map[string]map[string]string{},
+	}
+}
+
+// Copy copies the manifest referenced by source with all its blobs to
+// destination. Indexes are copied with every image they reference, which
+// is equivalent to `skopeo copy --all`, unless platforms are given. Then
+// a filtered index with only those platforms is pushed. It returns the digest
+// of the copied manifest.
+func (c *imageCopier) Copy(ctx context.Context, source, destination imageReference, platforms []string) (string, error) {
+	b, mediaType, digest, err := c.client.GetManifest(ctx, source)
+	if err != nil {
+		return "", fmt.Errorf("error getting manifest of %q: %w", source, err)
+	}
+	if source.Digest != "" && source.Digest != digest {
+		return "", fmt.Errorf("manifest of %q has digest %q", source, digest)
+	}
+	b, err = selectPlatforms(source, b, mediaType, platforms)
+	if err != nil {
+		return "", err
+	}
+	if err := c.copyManifest(ctx, source, destination, b, mediaType); err != nil {
+		return "", err
+	}
+	return digestOf(b), nil
+}
+
+// copyManifest pushes the manifest b to destination, after copying every
+// blob and child manifest it references.
+func (c *imageCopier) copyManifest(ctx context.Context, source, destination imageReference, b []byte, mediaType string) error {
+	switch {
+	case mediaType == mediaTypeDockerManifestSchema1 || mediaType == mediaTypeDockerManifestSchema1Signed:
+		return fmt.Errorf("%w: manifest of %q uses the deprecated Docker schema 1 format, which has to be pushed again as schema 2 or OCI upstream", errUnsupportedManifest, source)
+	case !slices.Contains(manifestMediaTypes, mediaType):
+		return fmt.Errorf("%w: manifest of %q has media type %q", errUnsupportedManifest, source, mediaType)
+	}
+	m, err := parseManifest(b)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest of %q: %w", source, err)
+	}
+
+	if isIndex(mediaType) {
+		for _, d := range m.Manifests {
+			childSource := imageReference{Registry: source.Registry, Repository: source.Repository, Digest: d.Digest}
+			childDestination := imageReference{Registry: destination.Registry, Repository: destination.Repository, Digest: d.Digest}
+			childB, childMediaType, _, err := c.client.GetManifest(ctx, childSource)
+			if err != nil {
+				return fmt.Errorf("error getting manifest of %q: %w", childSource, err)
+			}
+			if err := c.copyManifest(ctx, childSource, childDestination, childB, childMediaType); err != nil {
+				return err
+			}
+		}
+	} else {
+		blobs := m.Layers
+		if m.Config != nil {
+			blobs = append([]descriptor{*m.Config}, blobs...)
+		}
+		for _, d := range blobs {
+			if isForeignLayer(d) {
+				continue
+			}
+			if err := c.copyBlob(ctx, source, destination, d); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.client.PutManifest(ctx, destination, mediaType, b); err != nil {
+		return fmt.Errorf("error pushing manifest to %q: %w", destination, err)
+	}
+	return nil
+}
+
+// copyBlob ensures the blob exists in destination. Blobs already present are
+// skipped, blobs present in other repositories of the same registry are
+// mounted, and only the remaining ones are uploaded.
+func (c *imageCopier) copyBlob(ctx context.Context, source, destination imageReference, d descriptor) error {
+	exists, err := c.client.BlobExists(ctx, destination, d.Digest)
+	if err != nil {
+		return fmt.Errorf("error checking blob %q in %q: %w", d.Digest, destination.Name(), err)
+	}
+	if exists {
+		c.rememberBlob(destination, d.Digest)
+		return nil
+	}
+
+	if from := c.mountSource(destination, d.Digest); from != "" {
+		mounted, err := c.client.MountBlob(ctx, destination, d.Digest, from)
+		if err == nil && mounted {
+			return nil
+		}
+	}
+
+	newBody := func() (io.ReadCloser, error) {
+		return c.openSourceBlob(ctx, source, d)
+	}
+	blobPath, err := c.download(ctx, source, d)
+	switch {
+	case errors.Is(err, errDiskUsageExceeded):
+		// The blob is streamed from the source for every attempt instead.
+	case err != nil:
+		return err
+	default:
+		newBody = func() (io.ReadCloser, error) {
+			return os.Open(blobPath)
+		}
+	}
+	if err := c.client.UploadBlob(ctx, destination, d.Digest, d.Size, newBody); err != nil {
+		return err
+	}
+	c.rememberBlob(destination, d.Digest)
+	return nil
+}
+
+// openSourceBlob returns the content of the blob in source, failing at the end
+// of the content if it does not match the digest.
+func (c *imageCopier) openSourceBlob(ctx context.Context, source imageReference, d descriptor) (io.ReadCloser, error) {
+	body, err := c.client.GetBlob(ctx, source, d.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("error getting blob %q from %q: %w", d.Digest, source.Name(), err)
+	}
+	return &verifyingReader{ReadCloser: body, digest: d.Digest, hash: sha256.New()}, nil
+}
+
+// verifyingReader returns an error instead of io.EOF, if the content read
+// does not match the digest.
+type verifyingReader struct {
+	io.ReadCloser
+	digest string
+	hash   hash.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if actual := "sha256:" + hex.EncodeToString(r.hash.Sum(nil)); actual != r.digest {
+			return n, fmt.Errorf("blob %q has digest %q", r.digest, actual)
+		}
+	}
+	return n, err
+}
+
+// download stores the blob in the copier's directory and returns its path.
+// Concurrent calls for the same digest wait for a single download. It returns
+// errDiskUsageExceeded if the blob does not fit in maxDiskUsage.
+func (c *imageCopier) download(ctx context.Context, source imageReference, d descriptor) (string, error) {
+	c.mu.Lock()
+	dl, ok := c.downloads[d.Digest]
+	if !ok {
+		if c.maxDiskUsage > 0 && c.diskUsage+d.Size > c.maxDiskUsage {
+			c.mu.Unlock()
+			return "", errDiskUsageExceeded
+		}
+		dl = &blobDownload{
+			done:         make(chan struct{}),
+			path:         path.Join(c.dir, strings.ReplaceAll(d.Digest, ":", "-")),
+			size:         d.Size,
+			repositories: map[string]bool{},
+		}
+		c.downloads[d.Digest] = dl
+		c.diskUsage += dl.size
+	}
+	dl.repositories[source.Name()] = true
+	c.mu.Unlock()
+
+	if ok {
+		<-dl.done
+		return dl.path, dl.err
+	}
+
+	dl.err = c.fetchBlob(ctx, source, d, dl.path)
+	if dl.err != nil {
+		// Allow the next caller to retry.
+		c.mu.Lock()
+		delete(c.downloads, d.Digest)
+		c.diskUsage -= dl.size
+		c.mu.Unlock()
+	}
+	close(dl.done)
+	return dl.path, dl.err
+}
+
+func (c *imageCopier) fetchBlob(ctx context.Context, source imageReference, d descriptor, blobPath string) error {
+	if err := os.MkdirAll(c.dir, 0750); err != nil {
+		return err
+	}
+	body, err := c.client.GetBlob(ctx, source, d.Digest)
+	if err != nil {
+		return fmt.Errorf("error getting blob %q from %q: %w", d.Digest, source.Name(), err)
+	}
+	defer body.Close()
+
+	f, err := os.Create(blobPath)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); err == nil && actual != d.Digest {
+		err = fmt.Errorf("content has digest %q", actual)
+	}
+	if err != nil {
+		_ = os.Remove(blobPath)
+		return fmt.Errorf("error downloading blob %q from %q: %w", d.Digest, source.Name(), err)
+	}
+	return nil
+}
+
+func (c *imageCopier) rememberBlob(ref imageReference, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mountSources[ref.Registry] == nil {
+		c.mountSources[ref.Registry] = map[string]string{}
+	}
+	c.mountSources[ref.Registry][digest] = ref.Repository
+}
+
+// mountSource returns a repository in ref's registry known to contain the
+// blob, other than ref's repository.
+func (c *imageCopier) mountSource(ref imageReference, digest string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if repository := c.mountSources[ref.Registry][digest]; repository != ref.Repository {
+		return repository
+	}
+	return ""
+}
+
+// Release removes blobs downloaded for the source repository from disk,
+// unless they are still used by other repositories. It must not be called
+// while copies from the repository are in progress.
+func (c *imageCopier) Release(repository string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for digest, dl := range c.downloads {
+		delete(dl.repositories, repository)
+		if len(dl.repositories) == 0 {
+			_ = os.Remove(dl.path)
+			delete(c.downloads, digest)
+			c.diskUsage -= dl.size
+		}
+	}
+}
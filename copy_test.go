@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestImageCopierCopy(t *testing.T) {
+	source := newTestRegistry(t)
+	destination := newTestRegistry(t)
+	source.auth = "bearer"
+	destination.auth = "bearer"
+	index := source.putIndex("upstream/app", "1.0", "amd64", "arm64")
+
+	copier := newImageCopier(newTestClient(), t.TempDir())
+	ctx := context.Background()
+	sourceRef := imageReference{Registry: source.host(), Repository: "upstream/app", Tag: "1.0"}
+	first := imageReference{Registry: destination.host(), Repository: "mirror/app", Tag: "1.0"}
+	second := imageReference{Registry: destination.host(), Repository: "other/app", Tag: "1.0"}
+
+	digest, err := copier.Copy(ctx, sourceRef, first, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != index.Digest {
+		t.Errorf("got digest %q, expected %q", digest, index.Digest)
+	}
+	if !destination.hasManifest("mirror/app", "1.0") {
+		t.Error("expected the index to be pushed")
+	}
+	// Both configs and layers, and the layer shared by both images.
+	const blobs = 5
+	if n := destination.count("upload"); n != blobs {
+		t.Errorf("got %d uploads, expected a single upload of each of the %d blobs", n, blobs)
+	}
+	if n := source.count("blob"); n != blobs {
+		t.Errorf("got %d blob downloads, expected %d", n, blobs)
+	}
+
+	// Blobs are mounted from the first repository and not downloaded again.
+	if _, err := copier.Copy(ctx, sourceRef, second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := destination.count("mount"); n != blobs {
+		t.Errorf("got %d mounts, expected %d", n, blobs)
+	}
+	if n := destination.count("upload"); n != blobs {
+		t.Errorf("got %d uploads, expected no uploads of mounted blobs", n-blobs)
+	}
+	if n := source.count("blob"); n != blobs {
+		t.Errorf("got %d blob downloads, expected no downloads of mounted blobs", n-blobs)
+	}
+
+	// Existing blobs are skipped.
+	if _, err := copier.Copy(ctx, sourceRef, first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := destination.count("upload") + destination.count("mount"); n != 2*blobs {
+		t.Errorf("got %d uploads and mounts, expected existing blobs to be skipped", n-2*blobs)
+	}
+}
+
+func TestImageCopierCopyPlatforms(t *testing.T) {
+	source := newTestRegistry(t)
+	destination := newTestRegistry(t)
+	source.putIndex("app", "1.0", "amd64", "arm64", "s390x")
+
+	copier := newImageCopier(newTestClient(), t.TempDir())
+	sourceRef := imageReference{Registry: source.host(), Repository: "app", Tag: "1.0"}
+	destinationRef := imageReference{Registry: destination.host(), Repository: "app", Tag: "1.0"}
+	if _, err := copier.Copy(context.Background(), sourceRef, destinationRef, []string{"linux/amd64"}); err != nil {
+		t.Fatal(err)
+	}
+	// The config and the layers of a single image.
+	if n := destination.count("upload"); n != 3 {
+		t.Errorf("got %d uploads, expected 3", n)
+	}
+}
+
+func TestImageCopierCopySchema1(t *testing.T) {
+	source := newTestRegistry(t)
+	destination := newTestRegistry(t)
+	source.putManifest("app", "1.0", mediaTypeDockerManifestSchema1Signed, map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "app",
+		"tag":           "1.0",
+	})
+
+	copier := newImageCopier(newTestClient(), t.TempDir())
+	sourceRef := imageReference{Registry: source.host(), Repository: "app", Tag: "1.0"}
+	destinationRef := imageReference{Registry: destination.host(), Repository: "app", Tag: "1.0"}
+	_, err := copier.Copy(context.Background(), sourceRef, destinationRef, nil)
+	if !errors.Is(err, errUnsupportedManifest) {
+		t.Errorf("expected an unsupported manifest error, got %v", err)
+	}
+	if destination.hasManifest("app", "1.0") {
+		t.Error("expected no manifest to be pushed")
+	}
+}
+
+func TestImageCopierCopyDiskUsage(t *testing.T) {
+	source := newTestRegistry(t)
+	destination := newTestRegistry(t)
+	source.putImage("app", "1.0", "amd64")
+
+	copier := newImageCopier(newTestClient(), t.TempDir())
+	// Only the config fits on disk, layers are streamed to every destination.
+	copier.maxDiskUsage = 40
+	sourceRef := imageReference{Registry: source.host(), Repository: "app", Tag: "1.0"}
+	for _, repository := range []string{"first/app", "second/app"} {
+		destinationRef := imageReference{Registry: destination.host(), Repository: repository, Tag: "1.0"}
+		if _, err := copier.Copy(context.Background(), sourceRef, destinationRef, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The config once, both layers for the first destination. The second
+	// destination mounts all of them.
+	if n := source.count("blob"); n != 3 {
+		t.Errorf("got %d blob downloads, expected 3", n)
+	}
+	if copier.diskUsage > copier.maxDiskUsage {
+		t.Errorf("got disk usage of %d bytes, expected at most %d", copier.diskUsage, copier.maxDiskUsage)
+	}
+	copier.Release(sourceRef.Name())
+	if copier.diskUsage != 0 {
+		t.Errorf("got disk usage of %d bytes after release, expected 0", copier.diskUsage)
+	}
+}
+
+func TestImageCopierCopyDigestMismatch(t *testing.T) {
+	source := newTestRegistry(t)
+	destination := newTestRegistry(t)
+	source.putImage("app", "1.0", "amd64")
+	source.mu.Lock()
+	for digest := range source.blobs["app"] {
+		source.blobs["app"][digest] = []byte("tampered")
+	}
+	source.mu.Unlock()
+
+	// Streamed blobs are verified like downloaded ones.
+	for _, maxDiskUsage := range []int64{0, 1} {
+		copier := newImageCopier(newTestClient(), t.TempDir())
+		copier.maxDiskUsage = maxDiskUsage
+		sourceRef := imageReference{Registry: source.host(), Repository: "app", Tag: "1.0"}
+		destinationRef := imageReference{Registry: destination.host(), Repository: "app", Tag: "1.0"}
+		if _, err := copier.Copy(context.Background(), sourceRef, destinationRef, nil); err == nil {
+			t.Errorf("expected blobs with wrong digests to fail with a disk usage limit of %d", maxDiskUsage)
+		}
+	}
+	if n := destination.count("upload"); n != 0 {
+		t.Errorf("got %d uploads, expected none", n)
+	}
+}
+
+func TestCopyPoolStop(t *testing.T) {
+	pool := newCopyPool(1, nil, newImageCopier(newTestClient(), t.TempDir()))
+	pool.Stop()
+	results := pool.Execute([]plannedCopy{
+		{Source: "docker.io/library/alpine:3.18", Target: "example.com/giantswarm/alpine:3.18"},
+		{Source: "docker.io/library/alpine:3.19", Target: "example.com/giantswarm/alpine:3.19"},
+	})
+	if len(results) != 2 {
+		t.Fatalf("got %d results, expected 2", len(results))
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, errInterrupted) {
+			t.Errorf("got error %v copying %q, expected %v", r.Err, r.Source, errInterrupted)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultDestinations are used when neither --destinations-file nor
+// --destination flags are specified.
+var defaultDestinations = []destination{
+	{
+		Name:      "azure",
+		Registry:  "gsoci.azurecr.io",
+		Namespace: "giantswarm",
+	},
+	{
+		Name:      "aliyun",
+		Registry:  "giantswarm-registry.cn-shanghai.cr.aliyuncs.com",
+		Namespace: "giantswarm",
+	},
+}
+
+// destination is a registry namespace images are copied to.
+type destination struct {
+	// Name identifies the destination in logs and configuration.
+	// Example: "azure"
+	Name string `yaml:"name"`
+	// Registry is the host of the destination registry.
+	// Example: "gsoci.azurecr.io"
+	Registry string `yaml:"registry"`
+	// Namespace is the path under which all images are pushed. Optional.
+	// Example: "giantswarm"
+	Namespace string `yaml:"namespace,omitempty"`
+	// NameMapping renames repositories in this destination only. Keys are the
+	// repository names retagger would use otherwise, values are the names
+	// used instead.
+	// Example: {"alpinegit": "alpine-git"}
+	NameMapping map[string]string `yaml:"name_mapping,omitempty"`
+}
+
+// Repository returns the full name of the repository the image is pushed to
+// in this destination.
+// Example: "alpinegit" -> "gsoci.azurecr.io/giantswarm/alpinegit"
+func (d destination) Repository(name string) string {
+	if mapped, ok := d.NameMapping[name]; ok {
+		name = mapped
+	}
+	if d.Namespace == "" {
+		return d.Registry + "/" + name
+	}
+	return d.Registry + "/" + d.Namespace + "/" + name
+}
+
+func (d destination) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("%q is required", "name")
+	}
+	if d.Registry == "" {
+		return fmt.Errorf("%q is required", "registry")
+	}
+	if strings.Contains(d.Registry, "/") {
+		return fmt.Errorf("%q must be a registry host, use %q for the path", "registry", "namespace")
+	}
+	return nil
+}
+
+// loadDestinations returns destinations read from file and parsed from
+// flag values in the "<name>=<registry>[/<namespace>]" format. Defaults are
+// returned if neither is given.
+func loadDestinations(file string, flagValues []string) ([]destination, error) {
+	var destinations []destination
+
+	if file != "" {
+		file = filepath.Clean(file)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %q: %w", file, err)
+		}
+		// Unknown fields are rejected, so typos like "name_maping" do not
+		// silently push images to unexpected repositories.
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&destinations); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error unmarshaling %q: %w", file, err)
+		}
+	}
+
+	for _, value := range flagValues {
+		name, target, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid destination %q, expected format is <name>=<registry>[/<namespace>]", value)
+		}
+		registry, namespace, _ := strings.Cut(target, "/")
+		destinations = append(destinations, destination{
+			Name:      name,
+			Registry:  registry,
+			Namespace: namespace,
+		})
+	}
+
+	if len(destinations) == 0 {
+		return defaultDestinations, nil
+	}
+
+	names := map[string]bool{}
+	for i, d := range destinations {
+		if err := d.Validate(); err != nil {
+			return nil, fmt.Errorf("destination %d is invalid: %w", i, err)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("destination %q is defined more than once", d.Name)
+		}
+		names[d.Name] = true
+	}
+	return destinations, nil
+}
+
+// validateDestinationNames returns an error if any of the names is not one
+// of the configured destinations. Images would be skipped silently otherwise.
+func validateDestinationNames(names []string) error {
+	var unknown []string
+	for _, name := range names {
+		if !slices.ContainsFunc(destinations, func(d destination) bool { return d.Name == name }) {
+			unknown = append(unknown, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	var known []string
+	for _, d := range destinations {
+		known = append(known, fmt.Sprintf("%q", d.Name))
+	}
+	return fmt.Errorf("unknown destinations %s, configured destinations are %s", strings.Join(unknown, ", "), strings.Join(known, ", "))
+}
+
+// selectDestinations returns destinations allowed by the include and exclude
+// lists of destination names. An empty include list allows all destinations.
+func selectDestinations(all []destination, include, exclude []string) []destination {
+	var selected []destination
+	for _, d := range all {
+		if len(include) > 0 && !slices.Contains(include, d.Name) {
+			continue
+		}
+		if slices.Contains(exclude, d.Name) {
+			continue
+		}
+		selected = append(selected, d)
+	}
+	return selected
+}
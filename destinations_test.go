@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDestinations(t *testing.T) {
+	testCases := []struct {
+		name      string
+		file      string
+		flags     []string
+		expected  []string
+		expectErr string
+	}{
+		{
+			name:     "defaults",
+			expected: []string{"gsoci.azurecr.io/giantswarm/app", "giantswarm-registry.cn-shanghai.cr.aliyuncs.com/giantswarm/app"},
+		},
+		{
+			name:     "file and flags",
+			file:     "- name: azure\n  registry: gsoci.azurecr.io\n  namespace: giantswarm\n  name_mapping:\n    app: renamed-app\n",
+			flags:    []string{"local=localhost:5000"},
+			expected: []string{"gsoci.azurecr.io/giantswarm/renamed-app", "localhost:5000/app"},
+		},
+		{
+			name:      "unknown field",
+			file:      "- name: azure\n  registry: gsoci.azurecr.io\n  name_maping:\n    app: renamed-app\n",
+			expectErr: "field name_maping not found",
+		},
+		{
+			name:      "duplicate name",
+			flags:     []string{"local=localhost:5000", "local=localhost:5001"},
+			expectErr: "defined more than once",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var file string
+			if tc.file != "" {
+				file = filepath.Join(t.TempDir(), "destinations.yaml")
+				if err := os.WriteFile(file, []byte(tc.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			destinations, err := loadDestinations(file, tc.flags)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var repositories []string
+			for _, d := range destinations {
+				repositories = append(repositories, d.Repository("app"))
+			}
+			if strings.Join(repositories, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("got repositories %v, expected %v", repositories, tc.expected)
+			}
+		})
+	}
+}
+
+func TestValidateUnknownDestinations(t *testing.T) {
+	img := RenamedImage{Image: "alpine", TagOrPattern: "3.19", Destinations: []string{"azure"}}
+	if err := img.Validate(); err != nil {
+		t.Fatalf("expected known destination to be valid, got %v", err)
+	}
+	img.Destinations = []string{"azur"}
+	if err := img.Validate(); err == nil || !strings.Contains(err.Error(), `unknown destinations "azur"`) {
+		t.Errorf("expected unknown destination error, got %v", err)
+	}
+	img.Destinations = nil
+	img.ExcludeDestinations = []string{"aliyn"}
+	if err := img.Validate(); err == nil || !strings.Contains(err.Error(), `unknown destinations "aliyn"`) {
+		t.Errorf("expected unknown destination error, got %v", err)
+	}
+
+	options := skopeoImageOptions{ExcludeDestinations: []string{"azure", "foo"}}
+	if err := options.Validate(); err == nil || !strings.Contains(err.Error(), `unknown destinations "foo"`) {
+		t.Errorf("expected unknown destination error, got %v", err)
+	}
+}
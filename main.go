@@ -1,41 +1,75 @@
 // Package main is the retagger program.
 //
-// The program provides two commands:
-//   - `retagger run` - Performs retagging / renaming of the images defined in images/renamed-images.yaml.
-//   - `retagger filter <path>` - Processes skopeo YAML files in images/skopeo-* and creates a
-//     list of image syncing tasks to be performed. This is simple copyingf of images from one
-//     repository to another.
+// The program provides the following commands:
+//   - `retagger run` - Performs retagging / renaming of the images defined in a renamed images
+//     file, images/renamed-images.yaml by default.
+//   - `retagger plan` - Prints the copy operations `retagger run` would perform, without
+//     performing them.
+//   - `retagger validate [paths]` - Strictly validates renamed and skopeo files in images/ or
+//     the given paths, reporting all problems at once.
+//   - `retagger convert [paths]` - Converts skopeo and renamed files in images/ or the given
+//     paths to a single renamed images file, printed to stdout.
 package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
-	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	skopeoSyncOutputPattern = regexp.MustCompile(`Would have copied image.*?from="docker://(.*?)[@:](.*?)".*`)
-	temporaryWorkingDir     = path.Join(os.TempDir(), "retagger")
+	temporaryWorkingDir = path.Join(os.TempDir(), "retagger")
 
 	flagFile             string
 	flagLogLevel         string
 	flagExecutorCount    int
 	flagExecutorID       int
 	flagSkipExistingTags bool
+	flagDestinationsFile string
+	flagRegistriesFile   string
+	flagDestinations     []string
+	flagReportJSON       string
+	flagReportJUnit      string
+	flagOutput           string
+	flagTagCache         string
+	flagTagCacheMaxAge   time.Duration
+	flagConcurrency      int
+	flagBlobCacheSize    int64
+	flagRegistryLimits   []string
+	flagCompareDigests   bool
+	flagMutableTags      []string
+	flagShardWeights     []string
+	flagState            string
+	flagStateMaxAge      time.Duration
+	flagCheckpoint       string
+	flagResume           string
+	flagRetryFailed      string
+	flagPlatforms        []string
+	flagMissingPlatforms string
+	flagTagReplace       []string
+
+	// destinations are the registries images are copied to. They are
+	// configured with --destinations-file and --destination flags.
+	destinations []destination
+	// mutableTagPatterns are the compiled --mutable-tag patterns.
+	mutableTagPatterns []*regexp.Regexp
 
 	logStdOut = logrus.New()
 	logStdErr = logrus.New()
@@ -45,9 +79,6 @@ const (
 	renamedImagesFile  = "images/renamed-images.yaml"
 	dockerTransport    = "docker://"
 	filteredFileSuffix = ".filtered"
-
-	aliyunURL = "giantswarm-registry.cn-shanghai.cr.aliyuncs.com/giantswarm"
-	azureURL  = "gsoci.azurecr.io/giantswarm"
 )
 
 // RenamedImage represents a set of rules used to rebuild/retag multiple tags of
@@ -61,6 +92,10 @@ type RenamedImage struct {
 	// will be retagged. Required if SHA is specified.
 	// Example: "v1.[234].*" or ".*-stable"
 	TagOrPattern string `yaml:"tag_or_pattern,omitempty"`
+	// Tags lists exact tags to copy, like `images` of skopeo files. Tags of
+	// the source image are not listed then.
+	// Example: ["1.0", "2.0"]
+	Tags []string `yaml:"tags,omitempty"`
 	// SHA is used to filter image tags. If SHA is specified, it will take
 	// precedence over TagOrPattern. However TagOrPattern is still required!
 	// Example: 234cb88d3020898631af0ccbbcca9a66ae7306ecd30c9720690858c1b007d2a0
@@ -74,7 +109,13 @@ type RenamedImage struct {
 	//   Filter: "(.+)-alpine"  ->  Image tag: "3.12-alpine" -> Comparison: "3.12>=3.10"
 	//   Semver: ">= 3.10"          Extracted group: "3.12"
 	Filter string `yaml:"filter,omitempty"`
-	// AddTagSuffix is an extra string to append to the tag.
+	// DestinationTag is a Go template of the tag the image is pushed as. It
+	// has access to the source tag, its semver parts, and groups of Filter or
+	// TagOrPattern. See destinationTagData for all fields.
+	// Example: "{{.Major}}.{{.Minor}}.{{.Patch}}-gs" or `{{index .Groups 1}}`
+	DestinationTag string `yaml:"destination_tag,omitempty"`
+	// AddTagSuffix is an extra string to append to the tag. Deprecated, use
+	// DestinationTag instead.
 	// Example: "giantswarm", the tag would become "<tag>-giantswarm"
 	AddTagSuffix string `yaml:"add_tag_suffix,omitempty"`
 	// OverrideRepoName allows user to rewrite the name of the image entirely.
@@ -82,13 +123,61 @@ type RenamedImage struct {
 	// "gsoci.azurecr.io/giantswarm/alpinegit"
 	OverrideRepoName string `yaml:"override_repo_name,omitempty"`
 	// StripSemverPrefix removes the initial 'v' in 'v1.2.3' if enabled. Works
-	// only when Semver is defined.
+	// only when Semver is defined. Deprecated, use DestinationTag instead.
 	StripSemverPrefix bool `yaml:"strip_semver_prefix,omitempty"`
+	// Destinations limits the destinations the image is pushed to. All
+	// destinations are used if empty.
+	// Example: ["azure"]
+	Destinations []string `yaml:"destinations,omitempty"`
+	// ExcludeDestinations lists destinations the image is never pushed to,
+	// e.g. for licensed images.
+	// Example: ["aliyun"]
+	ExcludeDestinations []string `yaml:"exclude_destinations,omitempty"`
+	// AllowCollision allows other upstream images to be pushed to the same
+	// destination repository, which `retagger validate` rejects otherwise.
+	// It has to be set on every entry involved in the collision.
+	AllowCollision bool `yaml:"allow_collision,omitempty"`
+	// MutableTags lists names or regexp patterns of floating tags, which are
+	// copied on every run, or with --compare-digests only when they moved
+	// upstream. They extend the global --mutable-tag list.
+	// Example: ["stable", "nightly", "v[0-9]+"]
+	MutableTags []string `yaml:"mutable_tags,omitempty"`
+	// Platforms limits the platforms of multi-arch images copied, instead of
+	// all of them. It replaces the global --platform list.
+	// Example: ["linux/amd64", "linux/arm64"]
+	Platforms []string `yaml:"platforms,omitempty"`
+	// AssembleIndex groups per-architecture tags by the first group of Filter,
+	// or of TagOrPattern if Filter is not used. Besides copying every tag, an
+	// OCI image index of each group is pushed under the group's tag.
+	// Example:
+	//   Filter: "^(.+)-(amd64|arm64)$"  ->  Image tags: "1.0-amd64", "1.0-arm64"
+	//   AssembleIndex: true                 Index tag: "1.0"
+	AssembleIndex bool `yaml:"assemble_index,omitempty"`
+	// AliasTags are Go templates of floating tags pointing to the highest
+	// version among matched tags rendering to the same alias, like
+	// DestinationTag. Prereleases are not aliased. Requires Semver.
+	// Example: ["{{.Major}}.{{.Minor}}", "{{.Major}}"], so "1.11" and "1"
+	// point to "v1.11.3"
+	AliasTags []string `yaml:"alias_tags,omitempty"`
+
+	// mutableTagPatterns are MutableTags compiled by Validate.
+	mutableTagPatterns []*regexp.Regexp
+	// compiledTemplates are the group pattern and tag templates compiled by
+	// Validate.
+	compiledTemplates *tagTemplates
 }
 
 func (img *RenamedImage) Validate() error {
-	if img.TagOrPattern == "" && img.SHA == "" && img.Semver == "" {
-		return fmt.Errorf("neither %q, %q, nor %q specified", "tag_or_pattern", "semver", "sha")
+	if img.TagOrPattern == "" && img.SHA == "" && img.Semver == "" && len(img.Tags) == 0 {
+		return fmt.Errorf("neither %q, %q, %q, nor %q specified", "tag_or_pattern", "semver", "sha", "tags")
+	}
+	if len(img.Tags) > 0 && (img.TagOrPattern != "" || img.SHA != "" || img.Semver != "") {
+		return fmt.Errorf("%q cannot be used with %q, %q, or %q", "tags", "tag_or_pattern", "semver", "sha")
+	}
+	for _, tag := range img.Tags {
+		if !validTagPattern.MatchString(tag) {
+			return fmt.Errorf("invalid %q: %q is not a valid tag, use %q with %q to copy a digest", "tags", tag, "sha", "tag_or_pattern")
+		}
 	}
 	if img.SHA != "" && img.TagOrPattern == "" {
 		return fmt.Errorf("%q has to be specified when using %q", "tag_or_pattern", "sha")
@@ -102,131 +191,228 @@ func (img *RenamedImage) Validate() error {
 	if img.Semver == "" && img.StripSemverPrefix {
 		return fmt.Errorf("cannot strip semver prefix when %q is not defined", "semver")
 	}
+	if len(img.Destinations) > 0 && len(img.ExcludeDestinations) > 0 {
+		return fmt.Errorf("%q and %q are mutually exclusive", "destinations", "exclude_destinations")
+	}
+	if err := validateDestinationNames(img.Destinations); err != nil {
+		return fmt.Errorf("invalid %q: %w", "destinations", err)
+	}
+	if err := validateDestinationNames(img.ExcludeDestinations); err != nil {
+		return fmt.Errorf("invalid %q: %w", "exclude_destinations", err)
+	}
+	patterns, err := compileMutableTags(img.MutableTags)
+	if err != nil {
+		return fmt.Errorf("invalid %q: %w", "mutable_tags", err)
+	}
+	img.mutableTagPatterns = patterns
+	compiledTemplates, err := img.compileTagTemplates()
+	if err != nil {
+		return err
+	}
+	img.compiledTemplates = compiledTemplates
+	if err := validatePlatforms(img.Platforms); err != nil {
+		return fmt.Errorf("invalid %q: %w", "platforms", err)
+	}
+	if err := img.validateAssembleIndex(); err != nil {
+		return err
+	}
+	if err := img.validateDestinationTag(); err != nil {
+		return err
+	}
+	if err := img.validateAliasTags(); err != nil {
+		return err
+	}
 	return nil
 }
 
-// RetagUsingSHA pulls an image matching the SHA, retags, and pushes it to AzureCR and Aliyun.
+// repositoryName returns the name of the repository the image is pushed to
+// in every destination.
+// Example: "quay.io/cilium/operator" -> "operator"
+func (img *RenamedImage) repositoryName() string {
+	if img.OverrideRepoName != "" {
+		return img.OverrideRepoName
+	}
+	return imageBaseName(img.Image)
+}
+
+// selectedDestinations returns the destinations the image is pushed to.
+func (img *RenamedImage) selectedDestinations() []destination {
+	return selectDestinations(destinations, img.Destinations, img.ExcludeDestinations)
+}
+
+// RetagUsingSHA pulls an image matching the SHA, retags, and pushes it to all destinations.
 // Any optional parameters configured will be applied as well, e.g. tag suffix.
 // The pushed image will be tagged with the value of image.TagOrPattern.
-func (img *RenamedImage) RetagUsingSHA() error {
-	// Overwrite image name if applicable
-	destinationName := imageBaseName(img.Image)
-	if img.OverrideRepoName != "" {
-		destinationName = img.OverrideRepoName
+// Copy failures are reported in the returned imageResult.
+func (img *RenamedImage) RetagUsingSHA() (imageResult, error) {
+	plan, err := img.PlanUsingSHA()
+	if err != nil {
+		return imageResult{Image: img.Image}, err
 	}
-	// Add tag suffix if applicable
-	destinationTag := img.TagOrPattern
-	if img.AddTagSuffix != "" {
-		destinationTag = img.TagOrPattern + "-" + img.AddTagSuffix
+	return plan.Execute(), nil
+}
+
+// RetagUsingTags finds all tags matching the img.TagOrPattern or
+// img.Semver, retags, and pushes them to all destinations.
+// Any optional parameters configured will be applied as well, e.g. tag suffix.
+// Copy failures are reported in the returned imageResult.
+func (img *RenamedImage) RetagUsingTags() (imageResult, error) {
+	plan, err := img.PlanUsingTags()
+	if err != nil {
+		return imageResult{Image: img.Image}, err
 	}
+	return plan.Execute(), nil
+}
 
-	errorCounter := &atomic.Int64{}
+// Plan returns the copies needed to retag the image, using either SHA or
+// tags, whichever applies.
+func (img *RenamedImage) Plan() (imagePlan, error) {
+	if img.SHA != "" {
+		return img.PlanUsingSHA()
+	}
+	return img.PlanUsingTags()
+}
 
-	// We'll use skopeo copy for this, because it's awesome.
-	source := fmt.Sprintf("%s%s@sha256:%s", dockerTransport, img.Image, img.SHA)
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	// AzureCR
-	destination := fmt.Sprintf("%s%s/%s:%s", dockerTransport, azureURL, destinationName, destinationTag)
-	go copyImage(&wg, errorCounter, source, destination)
-	// Aliyun
-	destination = fmt.Sprintf("%s%s/%s:%s", dockerTransport, aliyunURL, destinationName, destinationTag)
-	go copyImage(&wg, errorCounter, source, destination)
-	wg.Wait()
+// PlanUsingSHA returns the copies RetagUsingSHA performs.
+func (img *RenamedImage) PlanUsingSHA() (imagePlan, error) {
+	plan := imagePlan{Image: img.Image}
 
-	if errorCount := errorCounter.Load(); errorCount > 0 {
-		return fmt.Errorf("finished %q with %d errors", img.Image, errorCount)
+	// Overwrite image name if applicable
+	destinationName := img.repositoryName()
+	imageDestinations := img.selectedDestinations()
+	if len(imageDestinations) == 0 {
+		logrus.Warnf("image %q has no destinations selected, skipping", img.Image)
+		return plan, nil
 	}
-	return nil
+
+	_, plan.NormalizedTags = img.withDestinationTags([]string{img.TagOrPattern})
+	destinationTag, err := img.renderDestinationTag(img.TagOrPattern)
+	if err != nil {
+		return plan, err
+	}
+
+	plan.MatchedTags = []string{img.TagOrPattern}
+
+	source := fmt.Sprintf("%s@sha256:%s", img.Image, img.SHA)
+	plan.Add(source, imageDestinations, destinationName, destinationTag, false, img.selectedPlatforms())
+
+	return plan, nil
 }
 
-// RetagUsingTags finds all tags matching the img.TagOrPattern or
-// img.Semver, retags, and pushes them to the Aliyun container registry.
-// Any optional parameters configured will be applied as well, e.g. tag suffix.
-func (img *RenamedImage) RetagUsingTags() error {
+// PlanUsingTags returns the copies RetagUsingTags performs.
+func (img *RenamedImage) PlanUsingTags() (imagePlan, error) {
+	plan := imagePlan{Image: img.Image}
+
 	// List available image tags
-	tags, err := listTags(img.Image)
+	tags, err := img.sourceTags()
 	if err != nil {
-		return err
+		return plan, err
 	}
 
 	// Overwrite image name if applicable
-	destinationName := imageBaseName(img.Image)
-	if img.OverrideRepoName != "" {
-		destinationName = img.OverrideRepoName
+	destinationName := img.repositoryName()
+
+	imageDestinations := img.selectedDestinations()
+	if len(imageDestinations) == 0 {
+		logrus.Warnf("image %q has no destinations selected, skipping", img.Image)
+		return plan, nil
 	}
 
 	// Filter the tags using TagOrPattern or Semver+Filter.
 	tags, err = img.FilterTags(tags)
 	if err != nil {
-		return fmt.Errorf("error filtering tags: %w", err)
+		return plan, fmt.Errorf("error filtering tags: %w", err)
 	}
+	tags, plan.NormalizedTags = img.withDestinationTags(tags)
+	plan.MatchedTags = tags
+	aliases := img.aliasTags(tags)
 
 	// Exclude tags existing in all registries
+	var presentTags [][]string
 	if flagSkipExistingTags {
-		azureTags, err := listTags(fmt.Sprintf("%s/%s", azureURL, destinationName))
-		if err != nil {
-			logrus.Warnf("error getting AzureCR tags: %s", err)
+		var wantedTags []string
+		for _, tag := range tags {
+			wantedTags = append(wantedTags, img.destinationTag(tag))
 		}
-		aliyunTags, err := listTags(fmt.Sprintf("%s/%s", aliyunURL, destinationName))
-		if err != nil {
-			logrus.Warnf("error getting Aliyun tags: %s", err)
+		if img.AssembleIndex {
+			for indexTag := range img.groupTags(plan.MatchedTags) {
+				wantedTags = append(wantedTags, img.destinationTag(indexTag))
+			}
+		}
+		for alias := range aliases {
+			wantedTags = append(wantedTags, alias)
+		}
+		for _, d := range imageDestinations {
+			destinationTags, err := destinationTags(d.Repository(destinationName), wantedTags)
+			if err != nil {
+				logrus.Warnf("error getting %s tags: %s", d.Name, err)
+			}
+			presentTags = append(presentTags, destinationTags)
+		}
+		tags = img.FindMissingTags(tags, presentTags...)
+		if flagCompareDigests {
+			sourceDigests := map[string]string{}
+			for _, d := range imageDestinations {
+				present := excluding(plan.MatchedTags, tags)
+				moved := findMovedTags(img.Image, present, d.Repository(destinationName), img.destinationTag, img.selectedPlatforms(), sourceDigests)
+				tags = append(tags, moved...)
+			}
+		}
+		for _, tag := range plan.MatchedTags {
+			if !slices.Contains(tags, tag) {
+				plan.SkippedTags = append(plan.SkippedTags, tag)
+			}
 		}
-		tags = img.FindMissingTags(tags, azureTags, aliyunTags)
 		logrus.Infof("Found %d missing tags for image %q", len(tags), img.Image)
 	}
 
-	errorCounter := &atomic.Int64{}
-
 	// Iterate through all found tags and retag ones matching the semver/pattern
 	for _, tag := range tags {
-		// Add tag suffix if applicable
-		destinationTag := tag
-		if img.AddTagSuffix != "" {
-			destinationTag = tag + "-" + img.AddTagSuffix
-		}
-		if img.Semver != "" && img.StripSemverPrefix {
-			destinationTag = strings.TrimPrefix(destinationTag, "v")
-		}
-
-		// We'll use skopeo copy for this, because it's awesome.
-		source := fmt.Sprintf("%s%s:%s", dockerTransport, img.Image, tag)
-		wg := sync.WaitGroup{}
-		wg.Add(2)
-		// Azure
-		destination := fmt.Sprintf("%s%s/%s:%s", dockerTransport, azureURL, destinationName, destinationTag)
-		go copyImage(&wg, errorCounter, source, destination)
-		// Aliyun
-		destination = fmt.Sprintf("%s%s/%s:%s", dockerTransport, aliyunURL, destinationName, destinationTag)
-		go copyImage(&wg, errorCounter, source, destination)
-		wg.Wait()
-
-		// We'll skip to the next tag
-		continue
+		source := fmt.Sprintf("%s:%s", img.Image, tag)
+		plan.Add(source, imageDestinations, destinationName, img.destinationTag(tag), img.IsMutableTag(tag), img.selectedPlatforms())
+	}
+	if img.AssembleIndex {
+		img.planIndexes(&plan, tags, imageDestinations, presentTags)
 	}
+	img.planAliases(&plan, aliases, tags, imageDestinations, presentTags)
+	plan.resolvePreviousDigests()
 
-	if errorCount := errorCounter.Load(); errorCount > 0 {
-		return fmt.Errorf("finished %q with %d errors", img.Image, errorCount)
+	return plan, nil
+}
+
+// sourceTags returns Tags, or all tags of the image listed in its registry.
+func (img *RenamedImage) sourceTags() ([]string, error) {
+	if len(img.Tags) > 0 {
+		return img.Tags, nil
 	}
-	return nil
+	return listTags(img.Image)
 }
 
 // FilterTags returns a trimmed down list of tags, based on defined rules. It
-// uses either a TagOrPattern, or Semver+Filter fields, whichever are defined.
-// Validate() function guarantees that only one method can be available at any
-// given time.
+// uses either Tags, TagOrPattern, or Semver+Filter fields, whichever are
+// defined. Validate() function guarantees that only one method can be
+// available at any given time.
 func (img *RenamedImage) FilterTags(tags []string) ([]string, error) {
 	var filteredTags []string
+	compiled, err := img.checkedTemplates()
+	if err != nil {
+		return filteredTags, err
+	}
 
-	// Filter by TagOrPattern...
-	if img.TagOrPattern != "" {
-		pattern, err := regexp.Compile(img.TagOrPattern)
-		if err != nil {
-			return filteredTags, fmt.Errorf("error compiling regexp pattern %q: %w", img.TagOrPattern, err)
+	// Filter by Tags...
+	if len(img.Tags) > 0 {
+		for _, tag := range tags {
+			if slices.Contains(img.Tags, tag) {
+				filteredTags = append(filteredTags, tag)
+			}
 		}
+		return filteredTags, nil
+	}
 
+	// or by TagOrPattern...
+	if img.TagOrPattern != "" {
 		for _, tag := range tags {
-			if pattern.MatchString(tag) {
+			if compiled.tagPattern.MatchString(tag) {
 				filteredTags = append(filteredTags, tag)
 			}
 		}
@@ -235,19 +421,10 @@ func (img *RenamedImage) FilterTags(tags []string) ([]string, error) {
 	}
 
 	// or by Semver (with Filter, if defined)
-	constraint, err := semver.NewConstraint(img.Semver)
-	if err != nil {
-		return filteredTags, fmt.Errorf("error compiling semver constraint %q: %w", img.Semver, err)
+	constraint, filter := compiled.semver, compiled.filter
+	if constraint == nil {
+		return filteredTags, fmt.Errorf("neither %q, %q, nor %q specified", "tag_or_pattern", "semver", "tags")
 	}
-	var filter *regexp.Regexp
-	if img.Filter != "" {
-		f, err := regexp.Compile(img.Filter)
-		if err != nil {
-			return filteredTags, fmt.Errorf("error compiling semver filter %q: %w", img.Filter, err)
-		}
-		filter = f
-	}
-
 	for _, tag := range tags {
 		semverToCompare := tag
 		if filter != nil {
@@ -281,6 +458,120 @@ func (img *RenamedImage) FilterTags(tags []string) ([]string, error) {
 	return filteredTags, nil
 }
 
+// selectedPlatforms returns the platforms copied for the image. All platforms
+// are copied if empty.
+func (img *RenamedImage) selectedPlatforms() []string {
+	if len(img.Platforms) > 0 {
+		return img.Platforms
+	}
+	return flagPlatforms
+}
+
+// IsMutableTag returns true if the tag matches the global or the image's
+// mutable tag patterns. The image's patterns are used only once compiled by
+// Validate.
+func (img *RenamedImage) IsMutableTag(tag string) bool {
+	return isMutableTag(tag, img.mutableTagPatterns)
+}
+
+// isMutableTag returns true if the tag matches any of the global
+// --mutable-tag patterns or the given ones.
+func isMutableTag(tag string, patterns []*regexp.Regexp) bool {
+	for _, r := range append(slices.Clone(mutableTagPatterns), patterns...) {
+		if r.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileMutableTags returns regexps matching whole tags for the patterns, or
+// an error if any of the patterns is not a valid regexp.
+// Example: "v[0-9]+" -> "^(?:v[0-9]+)$"
+func compileMutableTags(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		r, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("error compiling regexp pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+// findMovedTags returns tags, whose manifest digest in the target repository
+// differs from the source, e.g. because a mutable tag moved upstream or
+// a previous copy was interrupted. Digests are resolved with HEAD requests,
+// unless platforms are given. Then the source digest is the digest of the
+// filtered index. Source digests are cached in sourceDigests, so they can be
+// reused for other targets. Tags, whose digests cannot be resolved, are not
+// returned.
+func findMovedTags(source string, tags []string, target string, destinationTag func(string) string, platforms []string, sourceDigests map[string]string) []string {
+	var moved []string
+	for _, tag := range tags {
+		// Tags of images pinned by digest, e.g. in skopeo files, never move.
+		if strings.HasPrefix(tag, "sha256:") {
+			continue
+		}
+		sourceDigest, ok := sourceDigests[tag]
+		if !ok {
+			var err error
+			sourceDigest, err = sourceManifestDigest(source+":"+tag, platforms)
+			if err != nil {
+				logrus.Warnf("error getting digest of %s:%s: %v", source, tag, err)
+			}
+			sourceDigests[tag] = sourceDigest
+		}
+		if sourceDigest == "" {
+			continue
+		}
+
+		// The destination is always asked, since the tag may have been
+		// changed after the copy recorded in the state.
+		targetDigest, err := manifestDigest(target + ":" + destinationTag(tag))
+		if err != nil && !isNotFound(err) {
+			logrus.Warnf("error getting digest of %s:%s: %v", target, destinationTag(tag), err)
+			continue
+		}
+		if targetDigest != sourceDigest {
+			logrus.Debugf("tag %s:%s has digest %q, %q expected", target, destinationTag(tag), targetDigest, sourceDigest)
+			moved = append(moved, tag)
+		}
+	}
+	return moved
+}
+
+// manifestDigest returns the digest of the image's manifest.
+func manifestDigest(image string) (string, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return "", err
+	}
+	return defaultRegistryClient.HeadManifest(context.Background(), ref)
+}
+
+// sourceManifestDigest returns the digest of the manifest copied from the
+// image, taking platform filtering into account.
+func sourceManifestDigest(image string, platforms []string) (string, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return "", err
+	}
+	return defaultCopier.ManifestDigest(context.Background(), ref, platforms)
+}
+
+// excluding returns items of s, which are not in exclude.
+func excluding(s, exclude []string) []string {
+	var result []string
+	for _, v := range s {
+		if !slices.Contains(exclude, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
 // findMissingTags returns a list of items of the 'tags' slice that are missing
 // from at least one of the 'present' slices.
 func (img *RenamedImage) FindMissingTags(tags []string, present ...[]string) []string {
@@ -288,14 +579,7 @@ func (img *RenamedImage) FindMissingTags(tags []string, present ...[]string) []s
 	for _, tag := range tags {
 		tagIsMissing := false
 
-		destinationTag := tag
-		if img.AddTagSuffix != "" {
-			destinationTag = tag + "-" + img.AddTagSuffix
-		}
-		if img.Semver != "" && img.StripSemverPrefix {
-			destinationTag = strings.TrimPrefix(destinationTag, "v")
-		}
-
+		destinationTag := img.destinationTag(tag)
 		for _, existingTags := range present {
 			if !slices.Contains(existingTags, destinationTag) {
 				tagIsMissing = true
@@ -303,8 +587,9 @@ func (img *RenamedImage) FindMissingTags(tags []string, present ...[]string) []s
 			}
 		}
 
-		// We always want to attempt to sync these mutable tags
-		if tag == "latest" || tag == "develop" || tag == "debug" {
+		// We always want to attempt to sync mutable tags, unless digests are
+		// compared, which recopies them only when they moved upstream.
+		if !flagCompareDigests && img.IsMutableTag(tag) {
 			logrus.Tracef("image %s has a mutable tag (%s) so considering it missing", img.Image, tag)
 			tagIsMissing = true
 		}
@@ -316,11 +601,6 @@ func (img *RenamedImage) FindMissingTags(tags []string, present ...[]string) []s
 	return filteredTags
 }
 
-// skopeoTagList is used to unmarshal `skopeo list-tags` command output.
-type skopeoTagList struct {
-	Tags []string `yaml:"Tags"`
-}
-
 // skopeoFile is used to un/marshal YAML file format used by `skopeo sync`.
 // Only partial support is implemented, since we don't need the full functionality.
 // docs: https://github.com/containers/skopeo/blob/main/docs/skopeo-sync.1.md#yaml-file-content-used-source-for---src-yaml
@@ -329,48 +609,140 @@ type skopeoFile map[string]skopeoFileRegistry
 type skopeoFileRegistry struct {
 	// Images is a map of ImageName -> []Tags
 	Images map[string][]string `yaml:"images"`
+	// ImagesByTagRegex is a map of ImageName -> tag pattern.
+	ImagesByTagRegex map[string]string `yaml:"images-by-tag-regex,omitempty"`
+	// ImagesBySemver is a map of ImageName -> semver constraint.
+	ImagesBySemver map[string]string `yaml:"images-by-semver,omitempty"`
+	// TLSVerify is used to disable TLS verification of the registry.
+	TLSVerify *bool `yaml:"tls-verify,omitempty"`
+	// CertDir is a path to a directory with TLS certificates of the registry.
+	CertDir string `yaml:"cert-dir,omitempty"`
+	// Credentials are used to log in to the registry.
+	Credentials *skopeoCredentials `yaml:"credentials,omitempty"`
+	// ImageOptions is a map of ImageName -> retagger-specific options. It is
+	// ignored by skopeo.
+	ImageOptions map[string]skopeoImageOptions `yaml:"image-options,omitempty"`
+}
+
+type skopeoCredentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// hasImages returns true if any of the image lists is not empty.
+func (r skopeoFileRegistry) hasImages() bool {
+	return len(r.Images) > 0 || len(r.ImagesByTagRegex) > 0 || len(r.ImagesBySemver) > 0
+}
+
+// hasImage returns true if the image is synced by any of the image lists.
+func (r skopeoFileRegistry) hasImage(name string) bool {
+	_, inImages := r.Images[name]
+	_, inTagRegex := r.ImagesByTagRegex[name]
+	_, inSemver := r.ImagesBySemver[name]
+	return inImages || inTagRegex || inSemver
+}
+
+// skopeoImageOptions configures how retagger handles an image defined in
+// a skopeo file.
+type skopeoImageOptions struct {
+	// Destinations limits the destinations the image is pushed to. All
+	// destinations are used if empty.
+	// Example: ["azure"]
+	Destinations []string `yaml:"destinations,omitempty"`
+	// ExcludeDestinations lists destinations the image is never pushed to.
+	// Example: ["aliyun"]
+	ExcludeDestinations []string `yaml:"exclude-destinations,omitempty"`
+	// AllowCollision allows other upstream images to be pushed to the same
+	// destination repository, which `retagger validate` rejects otherwise.
+	AllowCollision bool `yaml:"allow-collision,omitempty"`
+	// MutableTags lists names or regexp patterns of floating tags. They
+	// extend the global --mutable-tag list.
+	// Example: ["stable", "nightly"]
+	MutableTags []string `yaml:"mutable-tags,omitempty"`
+	// Platforms limits the platforms of multi-arch images copied. `skopeo
+	// sync` copies all of them, so it is only kept by `retagger convert`, and
+	// rejected by `retagger validate`.
+	// Example: ["linux/amd64", "linux/arm64"]
+	Platforms []string `yaml:"platforms,omitempty"`
+}
+
+// errSkopeoPlatforms is returned for skopeo images with platforms, which
+// `skopeo sync` cannot filter.
+var errSkopeoPlatforms = errors.New("platforms cannot be synced with skopeo, convert the image with `retagger convert` and copy it with `retagger run`")
+
+// Validate returns the first problem found in the image options.
+func (o skopeoImageOptions) Validate() error {
+	if len(o.Destinations) > 0 && len(o.ExcludeDestinations) > 0 {
+		return fmt.Errorf("%q and %q are mutually exclusive", "destinations", "exclude-destinations")
+	}
+	if err := validateDestinationNames(o.Destinations); err != nil {
+		return fmt.Errorf("invalid %q: %w", "destinations", err)
+	}
+	if err := validateDestinationNames(o.ExcludeDestinations); err != nil {
+		return fmt.Errorf("invalid %q: %w", "exclude-destinations", err)
+	}
+	if _, err := compileMutableTags(o.MutableTags); err != nil {
+		return fmt.Errorf("invalid %q: %w", "mutable-tags", err)
+	}
+	if len(o.Platforms) > 0 {
+		return errSkopeoPlatforms
+	}
+	return nil
+}
+
+// selectedDestinations returns the destinations the image is pushed to.
+func (o skopeoImageOptions) selectedDestinations() []destination {
+	return selectDestinations(destinations, o.Destinations, o.ExcludeDestinations)
+}
+
+// destinationTags returns tags present in the destination repository. If
+// mirrorState knows all wanted tags to be present, the repository is not
+// listed.
+func destinationTags(repository string, wanted []string) ([]string, error) {
+	if tags, ok := mirrorState.PresentTags(repository, wanted); ok {
+		logrus.Debugf("all %d wanted tags of %q are present according to state", len(wanted), repository)
+		return tags, nil
+	}
+	tags, err := listTags(repository)
+	if err != nil {
+		return tags, err
+	}
+	mirrorState.RecordListed(repository, tags)
+	return tags, nil
 }
 
 // listTags gets a list of available tags for a given registry+image, for
 // example 'gsoci.azurecr.io/giantswarm/curl'.
 func listTags(image string) ([]string, error) {
-	var tags []string
-	var err error
+	ref, err := parseReference(image)
+	if err != nil {
+		return []string{}, err
+	}
 
+	if tags, ok := tagCache.Get(image); ok {
+		return tags, nil
+	}
+
+	var tags []string
 	for attempt := 0; attempt < 3; attempt++ {
 		attemptLogger := logStdOut.WithField("attempt", attempt+1)
 
-		c, stdout, stderr := command("skopeo", "list-tags", dockerTransport+image)
-		err = c.Run()
-		if err != nil && strings.Contains(stderr.String(), "repository name not known to registry") {
-			// This image has never been pushed to registry - has no synced tags.
-			return tags, nil
-		} else if err != nil && strings.Contains(stderr.String(), "name unknown") {
+		tags, err = defaultRegistryClient.ListTags(context.Background(), ref)
+		if isNotFound(err) {
 			// This image has never been pushed to registry - has no synced tags.
-			return tags, nil
+			return []string{}, nil
 		} else if err != nil {
-			err = fmt.Errorf("error listing tags for %q: %w\n%s", image, err, stderr.String())
+			err = fmt.Errorf("error listing tags for %q: %w", image, err)
 			attemptLogger.Warn(err)
 			continue
 		}
-
-		stl := skopeoTagList{
-			Tags: []string{},
-		}
-		err = yaml.Unmarshal(stdout.Bytes(), &stl)
-		if err != nil {
-			err = fmt.Errorf("error listing tags for %q: %w\n%s", image, err, stderr.String())
-			attemptLogger.Warn(err)
-			continue
-		}
-
-		tags = stl.Tags
 		break
 	}
 
 	if err != nil {
 		return []string{}, err
 	}
+	tagCache.Set(image, tags)
 	return tags, nil
 }
 
@@ -384,29 +756,56 @@ func imageBaseName(name string) string {
 	return elems[len(elems)-1]
 }
 
-// copyImage is a helper function used to invoke `skopeo copy`. Please note the
-// `--all`, which makes skopeo include ALL SHAs included in the tag's digest,
-// ensuring builds for all available platforms.
-func copyImage(wg *sync.WaitGroup, _ *atomic.Int64, source, destination string) {
-	defer wg.Done()
-	c, _, stderr := command("skopeo", "copy", "--all", "--retry-times", "3", source, destination)
+// copyImage is a helper function used to copy an image between registries.
+// Like `skopeo copy --all`, it includes ALL SHAs included in the tag's digest,
+// ensuring builds for all available platforms, unless platforms are given.
+// Canceling ctx interrupts the copy.
+func copyImage(ctx context.Context, source, destination string, platforms []string) copyResult {
+	result := copyResult{
+		Source:      source,
+		Destination: destination,
+	}
+	start := time.Now()
 	logrus.Debugf("copying %q to %q", source, destination)
-	if err := c.Run(); err != nil {
-		logrus.Errorf("error copying %q to %q: %v\n%s", source, destination, err, stderr.String())
-		return
+	result.Digest, result.Err = copyImageWithRetries(ctx, source, destination, platforms)
+	result.Duration = time.Since(start)
+	if result.Err != nil {
+		logrus.Errorf("error copying %q to %q: %v", source, destination, result.Err)
+		return result
 	}
 	logrus.Debugf("copied %q to %q", source, destination)
+	return result
 }
 
-// command is a helper function so I don't have to manually plug bytes.Buffer
-// into command streams every time ;_;
-func command(name string, args ...string) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer) {
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	c := exec.Command(name, args...)
-	c.Stdout = stdout
-	c.Stderr = stderr
-	return c, stdout, stderr
+// copyImageWithRetries copies the image using defaultCopier, waiting with an
+// exponential backoff between attempts. Blobs copied by a failed attempt are
+// not copied again by the next one. Unsupported manifests and interrupted
+// copies are not retried.
+func copyImageWithRetries(ctx context.Context, source, destination string, platforms []string) (string, error) {
+	sourceRef, err := parseReference(source)
+	if err != nil {
+		return "", err
+	}
+	destinationRef, err := parseReference(destination)
+	if err != nil {
+		return "", err
+	}
+
+	var digest string
+	for attempt := 0; attempt < 3; attempt++ {
+		digest, err = defaultCopier.Copy(ctx, sourceRef, destinationRef, platforms)
+		if err == nil {
+			return digest, nil
+		}
+		if errors.Is(err, errUnsupportedManifest) || ctx.Err() != nil {
+			break
+		}
+		logrus.WithField("attempt", attempt+1).Warnf("error copying %q to %q: %v", source, destination, err)
+		if attempt < 2 {
+			_ = sleep(ctx, backoffDelay(attempt))
+		}
+	}
+	return digest, err
 }
 
 func init() {
@@ -415,7 +814,30 @@ func init() {
 	// `retagger run` flags
 	flag.IntVar(&flagExecutorCount, "executor-count", 1, "Number of executors in a parallelized run. Used with 'retagger run'.")
 	flag.IntVar(&flagExecutorID, "executor-id", 0, "ID of the executor in a parallelized run. Used with 'retagger run'.")
+	flag.IntVar(&flagConcurrency, "concurrency", 8, "Maximum number of images planned and copies performed at once. Used with 'retagger run'.")
+	flag.Int64Var(&flagBlobCacheSize, "blob-cache-size", 10240, "Limits blobs kept on disk to be pushed to several destinations to the given number of MiB. Other blobs are streamed from the source to every destination. 0 disables the limit. Used with 'retagger run'.")
+	flag.StringArrayVar(&flagRegistryLimits, "registry-concurrency", nil, "Limits concurrent copies from or to a registry in the '<registry>=<limit>' format. Can be repeated. Used with 'retagger run'.")
+	flag.StringVar(&flagState, "state", "", "Reads tags present in destinations from and records copies to the given file, so registries are listed only for tags not known to be present. Used with 'retagger run' and 'retagger plan'.")
+	flag.DurationVar(&flagStateMaxAge, "state-max-age", 7*24*time.Hour, "Ignores state records older than the given duration, so deleted tags are eventually noticed. 0 disables expiration.")
+	flag.StringVar(&flagCheckpoint, "checkpoint", "", "Records every completed copy in the given file, which is truncated when the run completes. Used with 'retagger run'.")
+	flag.StringVar(&flagResume, "resume", "", "Skips copies completed according to the given checkpoint of an interrupted run, and keeps recording to it unless --checkpoint is set. Used with 'retagger run'.")
+	flag.StringVar(&flagRetryFailed, "retry-failed", "", "Processes only images and copies, which failed according to the given JSON report of a previous run. Used with 'retagger run'.")
+	flag.StringArrayVar(&flagPlatforms, "platform", nil, "Copies only the given platform of multi-arch images, in the '<os>/<architecture>[/<variant>]' format. Can be repeated. All platforms are copied by default.")
+	flag.StringVar(&flagMissingPlatforms, "missing-platforms", missingPlatformsFail, "Sets what happens if a platform is missing upstream: fail the copy, or warn and copy the others.")
+	flag.StringArrayVar(&flagShardWeights, "shard-weights", nil, "Reads JSON reports of previous runs from the given file or directory to balance images between executors. All executors must use the same reports. Can be repeated. Used with 'retagger run'.")
 	flag.BoolVar(&flagSkipExistingTags, "skip-existing-tags", true, "Skip tags which are already present in the target container registry. Used with 'retagger run'.")
+	flag.BoolVar(&flagCompareDigests, "compare-digests", false, "Consider tags missing if their manifest digest differs from the source, instead of comparing tag names only. Used with 'retagger run'.")
+	flag.StringArrayVar(&flagTagReplace, "tag-replace", []string{"+=_"}, "Replaces characters invalid in tags, like '+' of semver build metadata, in destination tags in the '<from>=<to>' format. Can be repeated, replaces the defaults. Used with 'retagger run' and 'retagger plan'.")
+	flag.StringArrayVar(&flagMutableTags, "mutable-tag", []string{"latest", "develop", "debug"}, "Sets a name or regexp pattern of floating tags, which are always considered missing, unless --compare-digests is set. Can be repeated, replaces the defaults. Used with 'retagger run'.")
+	flag.StringVar(&flagDestinationsFile, "destinations-file", "", "Sets the YAML file listing destination registries. Defaults to AzureCR and Aliyun.")
+	flag.StringVar(&flagRegistriesFile, "registries-file", "", "Sets the YAML file with tls_verify, cert_dir, and credentials of upstream registries. Used with 'retagger run', 'retagger plan', and 'retagger validate', and written by 'retagger convert'.")
+	flag.StringArrayVar(&flagDestinations, "destination", nil, "Adds a destination registry in the '<name>=<registry>[/<namespace>]' format. Can be repeated.")
+	flag.StringVar(&flagReportJSON, "report-json", "", "Writes a JSON report of the run to the given path. Used with 'retagger run'.")
+	flag.StringVar(&flagReportJUnit, "report-junit", "", "Writes a JUnit XML report of the run to the given path. Used with 'retagger run'.")
+	// `retagger plan` flags
+	flag.StringVar(&flagOutput, "output", planOutputTable, "Sets the output format: table, json, or markdown. Used with 'retagger plan'.")
+	flag.StringVar(&flagTagCache, "tag-cache", "", "Reads tag lists from and saves them to the given file instead of always querying registries. Used with 'retagger plan'.")
+	flag.DurationVar(&flagTagCacheMaxAge, "tag-cache-max-age", time.Hour, "Ignores tag lists cached longer than the given duration, so new tags are eventually listed. 0 disables expiration. Used with 'retagger plan'.")
 	flag.Parse()
 
 	logrus.SetFormatter(&logrus.TextFormatter{})
@@ -434,6 +856,44 @@ func init() {
 	logStdOut.SetLevel(lvl)
 	logStdOut.Out = os.Stdout
 	logStdErr.Out = os.Stderr
+
+	destinations, err = loadDestinations(flagDestinationsFile, flagDestinations)
+	if err != nil {
+		logrus.Fatalf("error loading destinations: %s", err)
+	}
+
+	mutableTagPatterns, err = compileMutableTags(flagMutableTags)
+	if err != nil {
+		logrus.Fatalf("invalid %q flag: %s", "mutable-tag", err)
+	}
+
+	tagReplacer, err = parseTagReplacements(flagTagReplace)
+	if err != nil {
+		logrus.Fatalf("invalid %q flag: %s", "tag-replace", err)
+	}
+
+	if err := validatePlatforms(flagPlatforms); err != nil {
+		logrus.Fatalf("invalid %q flag: %s", "platform", err)
+	}
+	if flagMissingPlatforms != missingPlatformsFail && flagMissingPlatforms != missingPlatformsWarn {
+		logrus.Fatalf("invalid %q flag %q, use one of: %s, %s", "missing-platforms", flagMissingPlatforms, missingPlatformsFail, missingPlatformsWarn)
+	}
+
+	registryLimits, err := parseRegistryLimits(flagRegistryLimits)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if flagBlobCacheSize < 0 {
+		logrus.Fatalf("%q cannot be lower than 0", "blob-cache-size")
+	}
+	defaultCopier.maxDiskUsage = flagBlobCacheSize << 20
+	defaultCopyPool = newCopyPool(flagConcurrency, registryLimits, defaultCopier)
+
+	if flagState != "" {
+		if err := mirrorState.Load(flagState, flagStateMaxAge); err != nil {
+			logrus.Fatal(err)
+		}
+	}
 }
 
 // commandRun is invoked when `retagger run` is called.
@@ -448,6 +908,9 @@ func commandRun() {
 	if flagExecutorCount > 10 {
 		logrus.Warnf("%q is set to %d, are you sure that's on purpose?", "executor-count", flagExecutorCount)
 	}
+	if flagConcurrency < 1 {
+		logrus.Fatalf("%q cannot be lower than 1", "concurrency")
+	}
 
 	if err := os.MkdirAll(temporaryWorkingDir, 0750); err != nil {
 		logrus.Fatal(err)
@@ -471,176 +934,231 @@ func commandRun() {
 	}
 
 	logger.Infof("Found %d images to rename and copy", len(renamedImages))
+	loadRegistries()
 
-	// Iterate over every image x tag and retag/rebuild it
-	errorCounter := 0
+	// Shard images between executors by their shard keys, so assignments do
+	// not change when entries are added, reordered, or edited. Keys identify
+	// entries in checkpoints.
+	keys := make([]string, len(renamedImages))
+	shardKeys := make([]string, len(renamedImages))
 	for i, image := range renamedImages {
-		// Skip images meant for other executors
-		if i%flagExecutorCount != flagExecutorID {
-			continue
+		keys[i] = image.Key()
+		shardKeys[i] = image.ShardKey()
+	}
+	weights, err := loadShardWeights(flagShardWeights, flagFile)
+	if err != nil {
+		logger.Fatalf("error loading shard weights: %s", err)
+	}
+	logger.Infof("Loaded shard weights of %d images", len(weights))
+
+	// Images and copies completed by an interrupted run are skipped when
+	// resuming it.
+	var completed resumedRun
+	if flagResume != "" {
+		completed, err = loadCheckpoint(flagResume)
+		if err != nil {
+			logger.Fatal(err)
 		}
-		if err := image.Validate(); err != nil {
-			logger.Errorf("[%d/%d] %q error: %s", i+1, len(renamedImages), image.Image, err)
-			errorCounter++
-			continue
+		logger.Infof("Resuming from %q with %d completed images and %d completed copies", flagResume, len(completed.images), len(completed.copies))
+		if flagCheckpoint == "" {
+			flagCheckpoint = flagResume
 		}
-		logger.Printf("[%d/%d] Retagging %q", i+1, len(renamedImages), image.Image)
-		if image.SHA != "" {
-			if err := image.RetagUsingSHA(); err != nil {
-				logger.Errorf("got error: %v", err)
-				errorCounter++
-			}
-		} else {
-			if err := image.RetagUsingTags(); err != nil {
-				logger.Errorf("got error: %v", err)
-				errorCounter++
-			}
+	}
+	if flagCheckpoint != "" {
+		if err := copyCheckpoint.Open(flagCheckpoint); err != nil {
+			logger.Fatal(err)
 		}
 	}
 
-	if errorCounter > 0 {
-		logger.Fatalf("Retagging ended with %d errors", errorCounter)
+	var failures *runFailures
+	if flagRetryFailed != "" {
+		f, err := loadRunFailures(flagRetryFailed)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		failures = &f
+		logger.Infof("Retrying %d images and %d copies failed according to %q", len(f.images), len(f.copies), flagRetryFailed)
 	}
-	logger.Infof("Done retagging %d images with no errors", len(renamedImages))
-}
 
-// commandFilter is invoked when `retagger filter` is called.
-//
-// The function reads a skopeo configuration file and runs `skopeo sync --dry-run`
-// with it. The output is processed for image tags to be synced. Each tag checked
-// against AzureCR and Aliyun. If a tag is missing in any of the registries,
-// it is added to the list of tags to be synced. The list is stored in a file next
-// to the input file, with the name suffixed with `.filtered`.
-func commandFilter(filePath string) {
-	if filePath == "" {
-		logrus.Fatal("You need to specify filepath: 'retagger filter <path>'")
-	}
-	logStdOut.WithField("file", filePath)
-	logStdErr.WithField("file", filePath)
-
-	logStdOut.Infof("Listing images & tags")
-	missingTagsPerImage := map[string][]string{}
+	// Stop copying on SIGTERM, e.g. sent by timeout, so the report, state, and
+	// checkpoint of the copies completed so far are still written. Another
+	// signal kills the run.
+	interrupted, stopNotify := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-interrupted.Done()
+		stopNotify()
+		logger.Warnf("Interrupted, stopping copies")
+		defaultCopyPool.Stop()
+	}()
+
+	// Retag images concurrently. All copies share defaultCopyPool, which
+	// limits how many of them are performed at once.
+	type runResult struct {
+		result imageResult
+		err    error
+	}
+	shards := assignShards(shardKeys, weights, flagExecutorCount)
 	{
-		filterPrefix := "auniqueprefixa"
-		c, _, stderr := command("skopeo", "sync", "--all", "--dry-run", "--src", "yaml", "--dest", "docker", filePath, filterPrefix)
-		if err := c.Run(); err != nil {
-			logStdErr.WithField("stderr", stderr.String())
-			logStdErr.Fatalf("error running 'skopeo sync --dry-run': %v", err)
+		count := 0
+		for _, shard := range shards {
+			if shard == flagExecutorID {
+				count++
+			}
 		}
-
-		tagsPerImage := map[string][]string{}
-
-		matches := skopeoSyncOutputPattern.FindAllStringSubmatch(stderr.String(), -1)
-		if matches == nil {
-			logStdErr.WithField("stderr", stderr.String())
-			logStdErr.Fatalf("found no images or tags in 'skopeo sync' output")
+		logger.Infof("Executor got %d of %d images", count, len(renamedImages))
+	}
+	results := make([]*runResult, len(renamedImages))
+	semaphore := make(chan struct{}, flagConcurrency)
+	wg := sync.WaitGroup{}
+	for i, image := range renamedImages {
+		// Skip images meant for other executors
+		if shards[i] != flagExecutorID {
+			continue
 		}
-		for _, m := range matches {
-			// by index: 0 - entire line, 1 - image name, 2 - tag
-			image := strings.TrimPrefix(m[1], filterPrefix+"/")
-			tag := m[2]
-			tagsPerImage[image] = append(tagsPerImage[image], tag)
+		// Skip images, which did not fail in the run being retried
+		if failures != nil && !failures.Includes(image) {
+			continue
 		}
-
-		logStdOut.Infof("Found %d images, checking how many tags are missing", len(tagsPerImage))
-		missingTagCount := 0
-		for image, tags := range tagsPerImage {
-			logStdOut.WithField("image", image).Debugf("searching for missing tags")
-			azureTags, err := listTags(fmt.Sprintf("%s/%s", azureURL, imageBaseName(image)))
-			if err != nil {
-				logStdErr.WithField("image", image).Errorf("error listing AzureCR tags: %v", err)
-				continue
+		// Skip images completed before resuming, without planning them
+		if completed.images[keys[i]] {
+			logger.Infof("[%d/%d] Skipping %q completed before resuming", i+1, len(renamedImages), image.Image)
+			continue
+		}
+		results[i] = &runResult{result: imageResult{Image: image.Image, Key: keys[i], ShardKey: shardKeys[i]}}
+		if err := image.Validate(); err != nil {
+			logger.Errorf("[%d/%d] %q error: %s", i+1, len(renamedImages), image.Image, err)
+			results[i].err = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, image RenamedImage) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			if interrupted.Err() != nil {
+				<-semaphore
+				results[i].err = errInterrupted
+				return
 			}
-			aliyunTags, err := listTags(fmt.Sprintf("%s/%s", aliyunURL, imageBaseName(image)))
+			plan, err := image.Plan()
+			<-semaphore
 			if err != nil {
-				logStdErr.WithField("image", image).Errorf("error listing Aliyun tags: %v", err)
-				continue
+				logger.Errorf("[%d/%d] %q error: %v", i+1, len(renamedImages), image.Image, err)
+				results[i].err = err
+				return
 			}
-			/*
-				Context: https://github.com/giantswarm/giantswarm/issues/31283
-
-				I am not sure what to think about the above code. The comment to the `commandFilter`
-				function states: `If a tag is missing in any of the registries, it is added to the
-				list of tags to be synced.`, what means in order to proceed with a given image we need
-				to establish the truth of:
-
-				ImgTagsMissingIn(Azure) ∨ ImgTagsMissingIn(Aliyun) ≡ T
-
-				In case any of the disjuncts is undefined, when error is returned, then obviously the
-				predicate is undefined and the image is skipped, so the code meets specification.
-
-				On the other hand, maybe the undefined state could be treated as false, what would change
-				the postcondition to:
-
-				ImgTagsMissingIn(Azure) = T ∨ ImgTagsMissingIn(Aliyun) = T ≡ T
-
-				The question of whether that's possible or not boils down to the question: does it pose
-				any danger to include an image if we do not know its state in the final registry? The
-				repository for it may not exist at all in the registry, it may be already present there,
-				with all the tags, or registry may not be accessible at all at the moment, etc.
-
-				Maybe there is no danger to it, what's implied by how the retagger gets executed. Assuming
-				tags are missing in one of the three registries, the retagger is anyway executed against
-				all three of them in the CircleCI, meaning it must have a way, which is the `skopeo`,
-				I believe, to account for tags already present in the destination registry. If so, the state
-				of registries, that already have tags in question, do not really matter. Tags state should
-				get correctly handled by the `skopeo` later, and in case there is a problem with the registry
-				or repository, we should get an error.
+			if failures != nil {
+				plan.Filter(func(c plannedCopy) bool { return failures.Retried(image, c) })
+			}
+			if skipped := plan.Filter(func(c plannedCopy) bool { return !completed.copies[copyKey(c.Source, c.Target)] }); skipped > 0 {
+				logger.Infof("[%d/%d] Skipping %d copies of %q completed before resuming", i+1, len(renamedImages), skipped, image.Image)
+			}
+			logger.Printf("[%d/%d] Retagging %q, %d copies", i+1, len(renamedImages), image.Image, len(plan.Copies))
+			results[i].result = plan.Execute()
+			results[i].result.Key = keys[i]
+			results[i].result.ShardKey = shardKeys[i]
+			if len(results[i].result.Failed()) == 0 {
+				if err := copyCheckpoint.RecordImage(keys[i]); err != nil {
+					logger.Errorf("error recording checkpoint: %v", err)
+				}
+			}
+		}(i, image)
+	}
+	wg.Wait()
 
-				On the other hand, it wouldn't make any difference for the original issue, linked on top, for
-				in its case the repository was missing in all three registries, so the result would still be
-				the same.
-			*/
-			i := &RenamedImage{}
-			missingTags := i.FindMissingTags(tags, azureTags, aliyunTags)
-			missingTagCount += len(missingTags)
-			missingTagsPerImage[image] = missingTags
+	// All images were processed, there is nothing to resume. Failed copies
+	// are retried with --retry-failed, since resuming would skip all
+	// completed images, including their new tags, until every copy succeeds.
+	// The checkpoint of an interrupted run is kept to resume it.
+	if interrupted.Err() == nil {
+		if err := copyCheckpoint.Complete(); err != nil {
+			logger.Errorf("error completing checkpoint: %v", err)
 		}
-		logStdOut.Infof("Found %d missing tags", missingTagCount)
 	}
 
-	logStdOut.Debugf("Saving filtered file")
-	filteredFile := skopeoFile{}
-	{
-		filePath = filepath.Clean(filePath)
-		b, err := os.ReadFile(filePath)
-		if err != nil {
-			logStdErr.Fatalf("error reading file: %v", err)
+	errorCounter := 0
+	var failedCopies []copyResult
+	runReport := newReport("run", flagFile)
+	for _, r := range results {
+		if r == nil {
+			continue
 		}
-		if err := yaml.Unmarshal(b, &filteredFile); err != nil {
-			logStdErr.Fatalf("error unmarshaling file: %v", err)
+		if r.err != nil {
+			errorCounter++
 		}
+		failedCopies = append(failedCopies, r.result.Failed()...)
+		for _, c := range r.result.Results {
+			if c.Err == nil {
+				if ref, err := parseReference(c.Destination); err == nil {
+					mirrorState.RecordCopy(c.Source, ref.Name(), ref.Tag, c.Digest)
+				}
+			}
+			if c.DigestChanged() {
+				logger.Infof("Mutable tag %q moved from %q to %q", c.Destination, c.PreviousDigest, c.Digest)
+			}
+		}
+		runReport.AddImage(r.result, r.err)
+	}
 
-		// Files are split by registry, so there is exactly one registry
-		// defined in each one of them.
-		registryName := maps.Keys(filteredFile)[0]
-		// Ensure empty images map.
-		filteredFile[registryName] = skopeoFileRegistry{
-			Images: make(map[string][]string),
+	if err := runReport.Write(); err != nil {
+		logger.Errorf("error writing report: %v", err)
+	}
+	if err := mirrorState.Save(); err != nil {
+		logger.Errorf("error saving state: %v", err)
+	}
+
+	if interrupted.Err() != nil {
+		if flagCheckpoint != "" {
+			logger.Infof("Resume the run with --resume %s", flagCheckpoint)
 		}
-		for fullImageName, tags := range missingTagsPerImage {
-			if len(tags) > 0 {
-				strippedImageName := strings.TrimPrefix(fullImageName, registryName)
-				strippedImageName = strings.TrimLeft(strippedImageName, "/")
-				filteredFile[registryName].Images[strippedImageName] = tags
-			}
+		logger.Fatalf("Retagging was interrupted with %d errors and %d failed copies", errorCounter, len(failedCopies))
+	}
+	for _, failed := range failedCopies {
+		logger.Errorf("Failed copying %q to %q after %s: %v", failed.Source, failed.Destination, failed.Duration.Round(time.Second), failed.Err)
+	}
+	if errorCounter > 0 || len(failedCopies) > 0 {
+		if flagReportJSON != "" {
+			logger.Infof("Retry failed images and copies with --retry-failed %s", flagReportJSON)
 		}
+		logger.Fatalf("Retagging ended with %d errors and %d failed copies", errorCounter, len(failedCopies))
 	}
+	logger.Infof("Done retagging %d images with no errors", len(renamedImages))
+}
 
-	b, err := yaml.Marshal(&filteredFile)
+// readSkopeoFile reads the skopeo file strictly, failing on unknown fields and
+// multiple documents. It also returns the document node, which comments of
+// images are converted from.
+func readSkopeoFile(path string) (skopeoFile, *yaml.Node, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		logStdErr.Fatalf("error marshaling file: %v", err)
+		return nil, nil, fmt.Errorf("error reading file: %w", err)
 	}
-	err = os.WriteFile(filePath+filteredFileSuffix, b, 0600)
-	if err != nil {
-		logStdErr.Fatalf("error writing file: %v", err)
+	file := skopeoFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshaling file: %w", err)
+	}
+	if err := decoder.Decode(&skopeoFile{}); !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("error unmarshaling file: only a single YAML document is supported")
+	}
+	if len(file) == 0 {
+		return nil, nil, fmt.Errorf("error unmarshaling file: no registries defined")
+	}
+	for registryName, registry := range file {
+		if !registry.hasImages() {
+			return nil, nil, fmt.Errorf("error unmarshaling file: registry %q defines no images", registryName)
+		}
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshaling file: %w", err)
 	}
-	logStdOut.Infof("Saved filtered file with missing tags")
+	return file, doc, nil
 }
 
 func main() {
 	if len(flag.Args()) == 0 {
-		fmt.Println("retagger run             Retag images\nretagger filter <path>   Filter missing tags for skopeo YAML file")
+		fmt.Println("retagger run             Retag images\nretagger plan            Print copies 'retagger run' would perform\nretagger validate [path] Validate files in images/ or the given paths\nretagger convert [path]  Convert files in images/ or the given paths to a renamed images file")
 		fmt.Println("")
 		flag.Usage()
 		os.Exit(0)
@@ -649,8 +1167,12 @@ func main() {
 	switch flag.Arg(0) {
 	case "run":
 		commandRun()
-	case "filter":
-		commandFilter(flag.Arg(1))
+	case "plan":
+		commandPlan()
+	case "validate":
+		commandValidate(flag.Args()[1:])
+	case "convert":
+		commandConvert(flag.Args()[1:])
 	default:
 		logrus.Fatalf("unknown command: %v", flag.Args())
 	}
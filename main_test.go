@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestIsMutableTag(t *testing.T) {
+	img := RenamedImage{Image: "alpine", TagOrPattern: ".*", MutableTags: []string{"stable", "v[0-9]+"}}
+	if err := img.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		tag      string
+		expected bool
+	}{
+		// Global defaults of --mutable-tag.
+		{"latest", true},
+		{"develop", true},
+		{"stable", true},
+		{"v1", true},
+		{"v1.2", false},
+		{"unstable", false},
+		{"latest-alpine", false},
+	}
+	for _, tc := range testCases {
+		if mutable := img.IsMutableTag(tc.tag); mutable != tc.expected {
+			t.Errorf("IsMutableTag(%q) = %t, expected %t", tc.tag, mutable, tc.expected)
+		}
+	}
+
+	img.MutableTags = []string{"("}
+	if err := img.Validate(); err == nil {
+		t.Error("expected invalid pattern to fail validation")
+	}
+}
+
+func TestSkopeoImageOptionsPlatforms(t *testing.T) {
+	options := skopeoImageOptions{Platforms: []string{"linux/amd64"}}
+	if err := options.Validate(); !errors.Is(err, errSkopeoPlatforms) {
+		t.Errorf("expected skopeo images with platforms to be rejected, got %v", err)
+	}
+}
+
+func TestRenamedImageTagTemplates(t *testing.T) {
+	img := RenamedImage{
+		Image:          "alpine",
+		Semver:         ">= 1.0",
+		Filter:         `^(.+)-alpine$`,
+		DestinationTag: "{{.Major}}.{{.Minor}}-{{index .Groups 1}}",
+		AliasTags:      []string{"{{.Major}}"},
+	}
+	if err := img.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if img.compiledTemplates == nil || img.compiledTemplates.groups == nil || img.compiledTemplates.semver == nil || len(img.compiledTemplates.aliasTags) != 1 {
+		t.Fatalf("expected Validate to compile the pattern and templates, got %+v", img.compiledTemplates)
+	}
+	if tag := img.destinationTag("1.2.3-alpine"); tag != "1.2-1.2.3" {
+		t.Errorf("got destination tag %q, expected %q", tag, "1.2-1.2.3")
+	}
+	tags, err := img.FilterTags([]string{"0.9-alpine", "1.2.3-alpine", "1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tags, []string{"1.2.3-alpine"}) {
+		t.Errorf("got filtered tags %v, expected %v", tags, []string{"1.2.3-alpine"})
+	}
+
+	// Images, which are not validated, compile them on every call.
+	unvalidated := RenamedImage{Image: "alpine", DestinationTag: "{{.Tag}}-gs"}
+	if tag := unvalidated.destinationTag("1.0"); tag != "1.0-gs" {
+		t.Errorf("got destination tag %q of an image not validated, expected %q", tag, "1.0-gs")
+	}
+
+	img.Filter = "("
+	if err := img.Validate(); err == nil {
+		t.Error("expected invalid filter to fail validation")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	planOutputTable    = "table"
+	planOutputJSON     = "json"
+	planOutputMarkdown = "markdown"
+)
+
+// imagePlan lists the copies needed to retag a single image definition.
+type imagePlan struct {
+	// Image is the source image name.
+	Image string `json:"image"`
+	// MatchedTags are source tags matching the image definition.
+	MatchedTags []string `json:"matchedTags"`
+	// SkippedTags are matched tags already present in all destinations.
+	SkippedTags []string `json:"skippedTags"`
+	// NormalizedTags is a map of source tag -> destination tag of tags, in
+	// which characters invalid in tags were replaced.
+	// Example: {"1.2.3+build.1": "1.2.3_build.1"}
+	NormalizedTags map[string]string `json:"normalizedTags,omitempty"`
+	// Error is set if the plan could not be computed.
+	Error string `json:"error,omitempty"`
+	// Copies contains one entry per tag and destination.
+	Copies []plannedCopy `json:"copies"`
+}
+
+// plannedCopy is a single copy operation.
+type plannedCopy struct {
+	// Source is the source image reference.
+	// Example: "quay.io/cilium/cilium:v1.15.0"
+	Source string `json:"source"`
+	// Sources are per-architecture source references assembled into an index
+	// pushed to Target. Source is the image name then.
+	// Example: ["cloudflare/cloudflared:2024.1.0-amd64", "cloudflare/cloudflared:2024.1.0-arm64"]
+	Sources []string `json:"sources,omitempty"`
+	// Destination is the destination name.
+	// Example: "azure"
+	Destination string `json:"destination"`
+	// Target is the destination image reference, with the final tag.
+	// Example: "gsoci.azurecr.io/giantswarm/cilium:1.15.0"
+	Target string `json:"target"`
+	// Tag is the final destination tag.
+	// Example: "1.15.0"
+	Tag string `json:"tag"`
+	// Mutable is true if the source tag matches the mutable tag policy.
+	Mutable bool `json:"mutable,omitempty"`
+	// PreviousDigest is the digest Target points to before the copy. It is
+	// only resolved for mutable tags.
+	PreviousDigest string `json:"previousDigest,omitempty"`
+	// Platforms limits the copied platforms of multi-arch images. All
+	// platforms are copied if empty.
+	// Example: ["linux/amd64", "linux/arm64"]
+	Platforms []string `json:"platforms,omitempty"`
+	// Error is set if the copy cannot be performed, e.g. because its tag
+	// cannot be rendered. Such copies fail without being attempted.
+	Error string `json:"error,omitempty"`
+}
+
+// Add plans copying source to the repository in all destinations.
+func (p *imagePlan) Add(source string, imageDestinations []destination, repositoryName, tag string, mutable bool, platforms []string) {
+	for _, d := range imageDestinations {
+		p.Copies = append(p.Copies, plannedCopy{
+			Source:      source,
+			Destination: d.Name,
+			Target:      fmt.Sprintf("%s:%s", d.Repository(repositoryName), tag),
+			Tag:         tag,
+			Mutable:     mutable,
+			Platforms:   platforms,
+		})
+	}
+}
+
+// describeSource returns Source, or the per-architecture sources of an
+// assembled index.
+// Example: "cloudflare/cloudflared:{2024.1.0-amd64,2024.1.0-arm64}"
+func (c plannedCopy) describeSource() string {
+	if len(c.Sources) == 0 {
+		return c.Source
+	}
+	var tags []string
+	for _, source := range c.Sources {
+		tags = append(tags, strings.TrimPrefix(source, c.Source+":"))
+	}
+	return fmt.Sprintf("%s:{%s}", c.Source, strings.Join(tags, ","))
+}
+
+// Filter removes copies for which keep returns false, and returns how many
+// were removed.
+func (p *imagePlan) Filter(keep func(c plannedCopy) bool) int {
+	var kept []plannedCopy
+	for _, c := range p.Copies {
+		if keep(c) {
+			kept = append(kept, c)
+		}
+	}
+	removed := len(p.Copies) - len(kept)
+	p.Copies = kept
+	return removed
+}
+
+// resolvePreviousDigests resolves digests destination tags of mutable copies
+// point to, so changes of mutable tags can be reported.
+func (p *imagePlan) resolvePreviousDigests() {
+	for i, c := range p.Copies {
+		if !c.Mutable {
+			continue
+		}
+		digest, err := manifestDigest(c.Target)
+		if err != nil && !isNotFound(err) {
+			logrus.Warnf("error getting digest of %s: %v", c.Target, err)
+		}
+		p.Copies[i].PreviousDigest = digest
+	}
+}
+
+// Execute performs all planned copies using defaultCopyPool. Copies with an
+// error are reported as failed.
+func (p imagePlan) Execute() imageResult {
+	var copies []plannedCopy
+	var failed []copyResult
+	for _, c := range p.Copies {
+		if c.Error == "" {
+			copies = append(copies, c)
+			continue
+		}
+		failed = append(failed, copyResult{
+			Source:          c.Source,
+			Destination:     c.Target,
+			DestinationName: c.Destination,
+			Tag:             c.Tag,
+			Err:             errors.New(c.Error),
+		})
+	}
+	return imageResult{
+		Image:          p.Image,
+		MatchedTags:    p.MatchedTags,
+		SkippedTags:    p.SkippedTags,
+		NormalizedTags: p.NormalizedTags,
+		Results:        append(failed, defaultCopyPool.Execute(copies)...),
+	}
+}
+
+// commandPlan is invoked when `retagger plan` is called.
+//
+// It prints every copy `retagger run` would perform for the renamed images
+// file, without performing any of them.
+func commandPlan() {
+	switch flagOutput {
+	case planOutputTable, planOutputJSON, planOutputMarkdown:
+	default:
+		logrus.Fatalf("unknown output format %q, use one of: %s, %s, %s", flagOutput, planOutputTable, planOutputJSON, planOutputMarkdown)
+	}
+
+	// Logs go to stderr, so the plan can be piped.
+	logStdOut.Out = os.Stderr
+
+	var renamedImages []RenamedImage
+	{
+		flagFile = filepath.Clean(flagFile)
+		b, err := os.ReadFile(flagFile)
+		if err != nil {
+			logrus.Fatalf("error reading %q: %s", flagFile, err)
+		}
+		if err := yaml.Unmarshal(b, &renamedImages); err != nil {
+			logrus.Fatalf("error unmarshaling %q: %s", flagFile, err)
+		}
+	}
+
+	loadRegistries()
+	loadTagCache()
+
+	plans := []imagePlan{}
+	errorCounter := 0
+	for i, image := range renamedImages {
+		logrus.Debugf("[%d/%d] Planning %q", i+1, len(renamedImages), image.Image)
+		plan := imagePlan{Image: image.Image}
+		err := image.Validate()
+		if err == nil {
+			plan, err = image.Plan()
+		}
+		if err != nil {
+			plan.Error = err.Error()
+			errorCounter++
+		}
+		for _, c := range plan.Copies {
+			if c.Error != "" {
+				errorCounter++
+			}
+		}
+		if plan.Copies == nil {
+			plan.Copies = []plannedCopy{}
+		}
+		plans = append(plans, plan)
+	}
+
+	if err := tagCache.Save(); err != nil {
+		logrus.Errorf("error saving tag cache: %v", err)
+	}
+	if err := mirrorState.Save(); err != nil {
+		logrus.Errorf("error saving state: %v", err)
+	}
+
+	var err error
+	switch flagOutput {
+	case planOutputJSON:
+		err = writePlanJSON(os.Stdout, plans)
+	case planOutputMarkdown:
+		err = writePlanMarkdown(os.Stdout, plans)
+	default:
+		err = writePlanTable(os.Stdout, plans)
+	}
+	if err != nil {
+		logrus.Fatalf("error writing plan: %v", err)
+	}
+
+	if errorCounter > 0 {
+		logrus.Fatalf("Planning ended with %d errors", errorCounter)
+	}
+}
+
+func writePlanJSON(w io.Writer, plans []imagePlan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plans)
+}
+
+// plannedCopyCount returns the number of copies in plans, which can be
+// performed. Copies, which failed planning, are not counted.
+func plannedCopyCount(plans []imagePlan) int {
+	count := 0
+	for _, p := range plans {
+		for _, c := range p.Copies {
+			if c.Error == "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func writePlanTable(w io.Writer, plans []imagePlan) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tTARGET")
+	for _, p := range plans {
+		if p.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\terror: %s\n", p.Image, p.Error)
+		}
+		for _, c := range p.Copies {
+			if c.Error != "" {
+				fmt.Fprintf(tw, "%s\t%s\terror: %s\n", c.describeSource(), c.Destination, c.Error)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.describeSource(), c.Destination, c.Target)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d copies planned for %d images\n", plannedCopyCount(plans), len(plans))
+	return err
+}
+
+func writePlanMarkdown(w io.Writer, plans []imagePlan) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "### retagger plan for `%s`\n\n", flagFile)
+	fmt.Fprintf(&sb, "%d copies planned for %d images.\n\n", plannedCopyCount(plans), len(plans))
+	sb.WriteString("| Source | Destination | Target |\n")
+	sb.WriteString("| --- | --- | --- |\n")
+	for _, p := range plans {
+		if p.Error != "" {
+			fmt.Fprintf(&sb, "| `%s` | - | :x: %s |\n", p.Image, markdownEscape(p.Error))
+		}
+		for _, c := range p.Copies {
+			if c.Error != "" {
+				fmt.Fprintf(&sb, "| `%s` | %s | :x: %s |\n", c.describeSource(), c.Destination, markdownEscape(c.Error))
+				continue
+			}
+			fmt.Fprintf(&sb, "| `%s` | %s | `%s` |\n", c.describeSource(), c.Destination, c.Target)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// markdownEscape makes s safe to use in a Markdown table cell.
+func markdownEscape(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.ReplaceAll(s, "\n", " ")
+}
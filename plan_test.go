@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePlanCopyCount(t *testing.T) {
+	plans := []imagePlan{{
+		Image: "cloudflare/cloudflared",
+		Copies: []plannedCopy{
+			{Source: "cloudflare/cloudflared:2024.1.0", Destination: "azure", Target: "gsoci.azurecr.io/giantswarm/cloudflared:2024.1.0"},
+			{Source: "cloudflare/cloudflared:2024.1.0", Destination: "aliyun", Error: "tag cannot be rendered"},
+		},
+	}}
+
+	// Both formats count only copies, which can be performed.
+	for name, write := range map[string]func(*bytes.Buffer) error{
+		"table":    func(b *bytes.Buffer) error { return writePlanTable(b, plans) },
+		"markdown": func(b *bytes.Buffer) error { return writePlanMarkdown(b, plans) },
+	} {
+		var b bytes.Buffer
+		if err := write(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(b.String(), "1 copies planned for 1 images") {
+			t.Errorf("expected %s plan to count 1 copy, got:\n%s", name, b.String())
+		}
+	}
+}
+
+func TestPlanAliasesMissingDestinations(t *testing.T) {
+	img := RenamedImage{Image: "quay.io/cilium/cilium", Semver: ">= 1.15", AliasTags: []string{"{{.Major}}.{{.Minor}}"}}
+	if err := img.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	imageDestinations := []destination{
+		{Name: "azure", Registry: "gsoci.azurecr.io", Namespace: "giantswarm"},
+		{Name: "aliyun", Registry: "giantswarm-registry.cn-shanghai.cr.aliyuncs.com", Namespace: "giantswarm"},
+	}
+	aliases := map[string]string{"1.15": "1.15.3"}
+	// The alias is missing in aliyun only, and its source tag is not copied.
+	presentTags := [][]string{{"1.15.3", "1.15"}, {"1.15.3"}}
+
+	plan := imagePlan{Image: img.Image}
+	img.planAliases(&plan, aliases, nil, imageDestinations, presentTags)
+	if len(plan.Copies) != 1 || plan.Copies[0].Destination != "aliyun" {
+		t.Fatalf("got copies %+v, expected the alias copied to aliyun only", plan.Copies)
+	}
+
+	// Aliases of copied tags are moved in every destination.
+	plan = imagePlan{Image: img.Image}
+	img.planAliases(&plan, aliases, []string{"1.15.3"}, imageDestinations, presentTags)
+	if len(plan.Copies) != len(imageDestinations) {
+		t.Errorf("got %d copies, expected the alias copied to all %d destinations", len(plan.Copies), len(imageDestinations))
+	}
+}
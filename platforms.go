@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	missingPlatformsFail = "fail"
+	missingPlatformsWarn = "warn"
+
+	// attestationReferenceAnnotation points attestation manifests, added to
+	// indexes by BuildKit, to the image manifest they describe.
+	attestationReferenceAnnotation = "vnd.docker.reference.digest"
+)
+
+// parsePlatform parses platforms in the "<os>/<architecture>[/<variant>]"
+// format.
+// Example: "linux/arm64" or "linux/arm/v7"
+func parsePlatform(s string) (platform, error) {
+	elems := strings.Split(s, "/")
+	if len(elems) < 2 || len(elems) > 3 || elems[0] == "" || elems[1] == "" {
+		return platform{}, fmt.Errorf("invalid platform %q, expected format is <os>/<architecture>[/<variant>]", s)
+	}
+	p := platform{OS: elems[0], Architecture: elems[1]}
+	if len(elems) == 3 {
+		p.Variant = elems[2]
+	}
+	return p, nil
+}
+
+// validatePlatforms returns an error if any of the platforms is invalid.
+func validatePlatforms(platforms []string) error {
+	for _, s := range platforms {
+		if _, err := parsePlatform(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches returns true if the descriptor's platform satisfies p. A variant is
+// only compared if p has one.
+func (p platform) matches(other *platform) bool {
+	if other == nil {
+		return false
+	}
+	return p.OS == other.OS && p.Architecture == other.Architecture && (p.Variant == "" || p.Variant == other.Variant)
+}
+
+func (p platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// filterIndex returns the index b with only manifests for the platforms,
+// and attestation manifests of the kept ones. All other fields are kept as
+// they are. It also returns platforms, which are not in the index.
+func filterIndex(b []byte, platforms []string) ([]byte, []string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, nil, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(fields["manifests"], &raw); err != nil {
+		return nil, nil, err
+	}
+	descriptors := make([]descriptor, len(raw))
+	for i := range raw {
+		if err := json.Unmarshal(raw[i], &descriptors[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var missing []string
+	kept := map[string]bool{}
+	for _, s := range platforms {
+		p, err := parsePlatform(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := false
+		for _, d := range descriptors {
+			if p.matches(d.Platform) {
+				kept[d.Digest] = true
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, s)
+		}
+	}
+
+	var filtered []json.RawMessage
+	for i, d := range descriptors {
+		if kept[d.Digest] || kept[d.Annotations[attestationReferenceAnnotation]] {
+			filtered = append(filtered, raw[i])
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, missing, fmt.Errorf("none of the platforms %s are in the index", strings.Join(platforms, ", "))
+	}
+
+	fields["manifests"], _ = json.Marshal(filtered)
+	filteredB, err := json.Marshal(fields)
+	return filteredB, missing, err
+}
+
+// selectPlatforms returns the manifest b filtered by platforms, if it is an
+// index and any platforms are given. Platforms missing in the index fail
+// according to --missing-platforms, or are logged.
+func selectPlatforms(ref imageReference, b []byte, mediaType string, platforms []string) ([]byte, error) {
+	if len(platforms) == 0 || !isIndex(mediaType) {
+		return b, nil
+	}
+	filtered, missing, err := filterIndex(b, platforms)
+	if err != nil {
+		return nil, fmt.Errorf("error filtering platforms of %q: %w", ref, err)
+	}
+	if len(missing) > 0 {
+		if flagMissingPlatforms != missingPlatformsWarn {
+			return nil, fmt.Errorf("platforms %s are missing in %q", strings.Join(missing, ", "), ref)
+		}
+		logrus.Warnf("platforms %s are missing in %q, copying the others", strings.Join(missing, ", "), ref)
+	}
+	return filtered, nil
+}
+
+// ManifestDigest returns the digest of the manifest Copy pushes for source
+// and the platforms, without copying anything.
+func (c *imageCopier) ManifestDigest(ctx context.Context, source imageReference, platforms []string) (string, error) {
+	if len(platforms) == 0 {
+		return c.client.HeadManifest(ctx, source)
+	}
+	b, mediaType, _, err := c.client.GetManifest(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	b, err = selectPlatforms(source, b, mediaType, platforms)
+	if err != nil {
+		return "", err
+	}
+	return digestOf(b), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// defaultCopyPool performs copies of `retagger run`. It is configured with
+// --concurrency and --registry-concurrency flags.
+var defaultCopyPool *copyPool
+
+// errInterrupted is the error of copies, which were not started before the
+// pool was stopped.
+var errInterrupted = errors.New("interrupted before it started")
+
+// copyPool is a bounded pool of workers performing copies. A copy counts
+// against the concurrency limits of both its source and destination
+// registries, and workers pick the first queued copy, which fits the limits,
+// so a busy registry does not block copies between other registries.
+//
+// Blobs downloaded for a source repository are removed from disk once no
+// queued or running copy uses the repository anymore.
+//
+// Stop interrupts running copies and fails queued ones.
+type copyPool struct {
+	// ctx is canceled by Stop.
+	ctx         context.Context
+	stop        context.CancelFunc
+	concurrency int
+	// registryLimits is a map of registry -> maximum concurrent copies.
+	// Registries not in the map are limited by concurrency only.
+	registryLimits map[string]int
+	copier         *imageCopier
+
+	startWorkers sync.Once
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        []*copyJob
+	// running is a map of registry -> number of running copies.
+	running map[string]int
+	// pending is a map of source repository -> number of queued and running
+	// copies.
+	pending map[string]int
+}
+
+type copyJob struct {
+	copy plannedCopy
+	// repository is the source repository name.
+	repository string
+	// registries are the source and destination registries.
+	registries []string
+	result     *copyResult
+	done       *sync.WaitGroup
+}
+
+func newCopyPool(concurrency int, registryLimits map[string]int, copier *imageCopier) *copyPool {
+	ctx, stop := context.WithCancel(context.Background())
+	p := &copyPool{
+		ctx:            ctx,
+		stop:           stop,
+		concurrency:    concurrency,
+		registryLimits: registryLimits,
+		copier:         copier,
+		running:        map[string]int{},
+		pending:        map[string]int{},
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// parseRegistryLimits parses flag values in the "<registry>=<limit>" format.
+func parseRegistryLimits(flagValues []string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, value := range flagValues {
+		registry, limit, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid registry concurrency %q, expected format is <registry>=<limit>", value)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid registry concurrency %q, limit has to be a positive number", value)
+		}
+		limits[normalizeRegistryHost(registry)] = n
+	}
+	return limits, nil
+}
+
+// Execute performs the copies and waits for them to finish. Results are in
+// the order of copies. Execute can be called concurrently, all calls share
+// the pool's workers.
+func (p *copyPool) Execute(copies []plannedCopy) []copyResult {
+	p.startWorkers.Do(func() {
+		for i := 0; i < p.concurrency; i++ {
+			go p.work()
+		}
+	})
+
+	results := make([]copyResult, len(copies))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(copies))
+
+	p.mu.Lock()
+	for i, c := range copies {
+		job := &copyJob{
+			copy:   c,
+			result: &results[i],
+			done:   wg,
+		}
+		// Invalid references fail in copyImage, they need no limits.
+		if source, err := parseReference(c.Source); err == nil {
+			job.repository = source.Name()
+			job.registries = append(job.registries, source.Registry)
+		}
+		if target, err := parseReference(c.Target); err == nil && !slices.Contains(job.registries, target.Registry) {
+			job.registries = append(job.registries, target.Registry)
+		}
+		p.pending[job.repository]++
+		p.queue = append(p.queue, job)
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	wg.Wait()
+	return results
+}
+
+func (p *copyPool) work() {
+	for {
+		p.mu.Lock()
+		job := p.next()
+		for job == nil {
+			p.cond.Wait()
+			job = p.next()
+		}
+		for _, r := range job.registries {
+			p.running[r]++
+		}
+		p.mu.Unlock()
+
+		switch {
+		case p.ctx.Err() != nil:
+			*job.result = copyResult{Source: job.copy.Source, Destination: job.copy.Target, Err: errInterrupted}
+		case len(job.copy.Sources) > 0:
+			*job.result = assembleImage(p.ctx, job.copy.Source, job.copy.Sources, job.copy.Target, job.copy.Platforms)
+		default:
+			*job.result = copyImage(p.ctx, job.copy.Source, job.copy.Target, job.copy.Platforms)
+		}
+		job.result.DestinationName = job.copy.Destination
+		job.result.Tag = job.copy.Tag
+		job.result.Mutable = job.copy.Mutable
+		job.result.PreviousDigest = job.copy.PreviousDigest
+		if err := copyCheckpoint.Record(*job.result); err != nil {
+			logrus.Errorf("error recording checkpoint: %v", err)
+		}
+
+		p.mu.Lock()
+		for _, r := range job.registries {
+			p.running[r]--
+		}
+		p.pending[job.repository]--
+		if p.pending[job.repository] == 0 {
+			delete(p.pending, job.repository)
+			p.copier.Release(job.repository)
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		job.done.Done()
+	}
+}
+
+// Stop interrupts running copies, and fails queued and later executed copies
+// with errInterrupted without performing them. Execute still returns
+// results of all copies.
+func (p *copyPool) Stop() {
+	p.stop()
+}
+
+// next removes the first queued job, which fits registry limits, from the
+// queue and returns it. It returns nil if there is no such job. It must be
+// called with p.mu locked.
+func (p *copyPool) next() *copyJob {
+	for i, job := range p.queue {
+		fits := true
+		for _, r := range job.registries {
+			if limit, ok := p.registryLimits[r]; ok && p.running[r] >= limit {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return job
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// registries are settings of upstream registries read from
+// --registries-file, a map of registry host -> settings.
+var registries = map[string]registrySettings{}
+
+// registrySettings configure access to an upstream registry, like tls-verify,
+// cert-dir, and credentials of skopeo registry sections. The registry client
+// uses a single configuration per registry, so they are set once per registry
+// instead of per image.
+type registrySettings struct {
+	// TLSVerify is used to disable TLS verification of the registry.
+	TLSVerify *bool `yaml:"tls_verify,omitempty"`
+	// CertDir is a path to a directory with TLS certificates of the registry.
+	CertDir string `yaml:"cert_dir,omitempty"`
+	// Credentials are used to log in to the registry.
+	Credentials *skopeoCredentials `yaml:"credentials,omitempty"`
+}
+
+// IsZero returns true if no setting is set, so the registry is accessed with
+// defaults.
+func (s registrySettings) IsZero() bool {
+	return s.TLSVerify == nil && s.CertDir == "" && s.Credentials == nil
+}
+
+// settings returns tls-verify, cert-dir, and credentials of the skopeo
+// registry section, which `skopeo sync` uses for the source.
+func (r skopeoFileRegistry) settings() registrySettings {
+	return registrySettings{TLSVerify: r.TLSVerify, CertDir: r.CertDir, Credentials: r.Credentials}
+}
+
+// configureClient applies the settings of the registry to the client.
+func (s registrySettings) configureClient(client *registryClient, registryName string) error {
+	if s.Credentials != nil {
+		client.SetCredentials(registryName, registryCredentials{
+			Username: s.Credentials.Username,
+			Password: s.Credentials.Password,
+		})
+	}
+	if s.CertDir == "" && (s.TLSVerify == nil || *s.TLSVerify) {
+		return nil
+	}
+	config, err := loadCertDir(s.CertDir)
+	if err != nil {
+		return err
+	}
+	config.InsecureSkipVerify = s.TLSVerify != nil && !*s.TLSVerify
+	client.SetTLSConfig(registryName, config)
+	return nil
+}
+
+// loadCertDir returns a TLS configuration trusting CA certificates (*.crt)
+// from the directory in addition to system ones, and using client
+// certificates (*.cert with a matching *.key), following the layout of
+// containers-certs.d. An empty dir results in the default configuration.
+// docs: https://github.com/containers/image/blob/main/docs/containers-certs.d.5.md
+func loadCertDir(dir string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if dir == "" {
+		return config, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cert-dir %q: %w", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch filepath.Ext(entry.Name()) {
+		case ".crt":
+			if config.RootCAs == nil {
+				config.RootCAs, err = x509.SystemCertPool()
+				if err != nil {
+					config.RootCAs = x509.NewCertPool()
+				}
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading %q: %w", path, err)
+			}
+			if !config.RootCAs.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificates found in %q", path)
+			}
+		case ".cert":
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path, keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client certificate %q: %w", path, err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+		}
+	}
+	return config, nil
+}
+
+// loadRegistries loads --registries-file, if any, and applies its settings to
+// defaultRegistryClient.
+func loadRegistries() {
+	if flagRegistriesFile == "" {
+		return
+	}
+	var err error
+	registries, err = loadRegistrySettings(flagRegistriesFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	configureRegistries(registries)
+}
+
+// configureRegistries applies settings of all registries to
+// defaultRegistryClient, in a stable order.
+func configureRegistries(settings map[string]registrySettings) {
+	names := maps.Keys(settings)
+	slices.Sort(names)
+	for _, name := range names {
+		if err := settings[name].configureClient(defaultRegistryClient, name); err != nil {
+			logrus.Fatalf("error configuring registry %q: %v", name, err)
+		}
+	}
+}
+
+// loadRegistrySettings reads a map of registry host -> settings from file
+// strictly, failing on unknown fields and on hosts defined more than once,
+// also under another name of the same registry, like "index.docker.io".
+// Example: {"registry.example.com": {tls_verify: false}}
+func loadRegistrySettings(file string) (map[string]registrySettings, error) {
+	file = filepath.Clean(file)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", file, err)
+	}
+	var settings map[string]registrySettings
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&settings); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error unmarshaling %q: %w", file, err)
+	}
+	normalized := map[string]registrySettings{}
+	for name, s := range settings {
+		host := normalizeRegistryHost(name)
+		if _, ok := normalized[host]; ok {
+			return nil, fmt.Errorf("error loading %q: registry %q is defined more than once", file, host)
+		}
+		normalized[host] = s
+	}
+	return normalized, nil
+}
+
+// addRegistrySettings adds settings of the registry to all. Registries without
+// settings are skipped. It fails if the registry already has different
+// settings, since only one of them could be applied.
+func addRegistrySettings(all map[string]registrySettings, registryName string, s registrySettings) error {
+	if s.IsZero() {
+		return nil
+	}
+	host := normalizeRegistryHost(registryName)
+	if existing, ok := all[host]; ok {
+		if !reflect.DeepEqual(existing, s) {
+			return fmt.Errorf("settings of registry %q conflict, tls-verify, cert-dir, and credentials have to be equal everywhere", host)
+		}
+		return nil
+	}
+	all[host] = s
+	return nil
+}
+
+// registrySettingsUse records registry settings of a skopeo registry section,
+// checked for conflicts across all files.
+type registrySettingsUse struct {
+	Registry string
+	Settings registrySettings
+
+	File   string
+	Line   int
+	Column int
+}
+
+// findRegistryConflicts reports registry sections, whose settings differ from
+// --registries-file or from other sections of the same registry. Only one of
+// them could be applied.
+func findRegistryConflicts(uses []registrySettingsUse) []validationProblem {
+	settings := maps.Clone(registries)
+	// firstUses are the uses each registry's settings were first seen in.
+	firstUses := map[string]registrySettingsUse{}
+	for host := range registries {
+		firstUses[host] = registrySettingsUse{File: flagRegistriesFile}
+	}
+
+	var problems []validationProblem
+	for _, u := range uses {
+		host := normalizeRegistryHost(u.Registry)
+		if err := addRegistrySettings(settings, u.Registry, u.Settings); err != nil {
+			first := firstUses[host]
+			location := first.File
+			if first.Line > 0 {
+				location = fmt.Sprintf("%s:%d", first.File, first.Line)
+			}
+			problems = append(problems, validationProblem{
+				File:    u.File,
+				Line:    u.Line,
+				Column:  u.Column,
+				Message: fmt.Sprintf("%v, first set in %s", err, location),
+			})
+			continue
+		}
+		if _, ok := firstUses[host]; !ok && !u.Settings.IsZero() {
+			firstUses[host] = u
+		}
+	}
+	return problems
+}
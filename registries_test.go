@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRegistrySettings(t *testing.T) {
+	testCases := []struct {
+		name      string
+		file      string
+		expected  []string
+		expectErr string
+	}{
+		{
+			name:     "settings",
+			file:     "registry.example.com:\n  tls_verify: false\nindex.docker.io:\n  credentials:\n    username: user\n    password: secret\n",
+			expected: []string{"docker.io", "registry.example.com"},
+		},
+		{
+			name:      "unknown field",
+			file:      "registry.example.com:\n  tls-verify: false\n",
+			expectErr: "field tls-verify not found",
+		},
+		{
+			name:      "same registry twice",
+			file:      "docker.io:\n  tls_verify: false\nindex.docker.io:\n  tls_verify: true\n",
+			expectErr: "defined more than once",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "registries.yaml")
+			if err := os.WriteFile(file, []byte(tc.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			settings, err := loadRegistrySettings(file)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hosts := sortedKeys(settings); strings.Join(hosts, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("got registries %v, expected %v", hosts, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFindRegistryConflicts(t *testing.T) {
+	insecure := false
+	secure := true
+	uses := []registrySettingsUse{
+		{Registry: "registry.example.com", Settings: registrySettings{TLSVerify: &insecure}, File: "skopeo-a.yaml", Line: 1},
+		// Sections without settings use the ones of the registry.
+		{Registry: "registry.example.com", File: "skopeo-b.yaml", Line: 1},
+		{Registry: "registry.example.com", Settings: registrySettings{TLSVerify: &insecure}, File: "skopeo-c.yaml", Line: 1},
+		{Registry: "registry.example.com", Settings: registrySettings{TLSVerify: &secure}, File: "skopeo-d.yaml", Line: 3},
+		{Registry: "docker.io", Settings: registrySettings{Credentials: &skopeoCredentials{Username: "user", Password: "secret"}}, File: "skopeo-a.yaml", Line: 5},
+		{Registry: "index.docker.io", Settings: registrySettings{Credentials: &skopeoCredentials{Username: "user", Password: "other"}}, File: "skopeo-b.yaml", Line: 7},
+	}
+	problems := findRegistryConflicts(uses)
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+		if strings.Contains(p.Message, "secret") || strings.Contains(p.Message, "other") {
+			t.Errorf("expected credentials not to be reported, got %q", p.Message)
+		}
+	}
+	expected := []string{
+		`skopeo-d.yaml:3:0: settings of registry "registry.example.com" conflict, tls-verify, cert-dir, and credentials have to be equal everywhere, first set in skopeo-a.yaml:1`,
+		`skopeo-b.yaml:7:0: settings of registry "docker.io" conflict, tls-verify, cert-dir, and credentials have to be equal everywhere, first set in skopeo-a.yaml:5`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got problems:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dockerHubRegistry    = "docker.io"
+	dockerHubAPIRegistry = "registry-1.docker.io"
+
+	// Error codes defined by the OCI distribution specification.
+	// docs: https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+	errorCodeNameUnknown     = "NAME_UNKNOWN"
+	errorCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	errorCodeBlobUnknown     = "BLOB_UNKNOWN"
+
+	// maxThrottledRetries is the number of times a request answered with
+	// 429 Too Many Requests is sent again.
+	maxThrottledRetries = 5
+	// defaultUploadChunkSize is the size of chunks of blobs uploaded in
+	// several requests.
+	defaultUploadChunkSize = 16 << 20
+)
+
+var (
+	// linkNextPattern extracts the URL of the next page from the `Link` header
+	// returned by paginated endpoints, e.g. `</v2/foo/tags/list?n=100&last=bar>; rel="next"`.
+	linkNextPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+	// challengeParamPattern extracts key="value" pairs from the
+	// `WWW-Authenticate` header.
+	challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+	defaultRegistryClient = newRegistryClient()
+
+	// retryBackoff is the delay before the first retry of a throttled
+	// request or a failed copy. It doubles with every further attempt.
+	retryBackoff = time.Second
+	// maxRetryDelay limits delays between retries, including delays asked
+	// for by registries in the `Retry-After` header.
+	maxRetryDelay = 2 * time.Minute
+)
+
+// imageReference is a parsed image name, e.g. "quay.io/cilium/cilium:v1.15.0".
+type imageReference struct {
+	// Registry is the host of the registry, e.g. "quay.io" or "docker.io".
+	Registry string
+	// Repository is the path of the image within the registry, e.g.
+	// "cilium/cilium" or "library/alpine".
+	Repository string
+	// Tag is optional.
+	Tag string
+	// Digest is optional. If both Tag and Digest are set, Digest is used to
+	// identify the manifest.
+	Digest string
+}
+
+// parseReference parses image names in the formats used across the images/
+// files, following the same defaulting rules as docker and skopeo. The
+// "docker://" transport prefix is accepted and ignored.
+// Example: "alpine" -> "docker.io/library/alpine"
+func parseReference(name string) (imageReference, error) {
+	ref := imageReference{}
+	name = strings.TrimPrefix(name, dockerTransport)
+	if name == "" {
+		return ref, fmt.Errorf("empty image reference")
+	}
+
+	if i := strings.Index(name, "@"); i != -1 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !strings.Contains(ref.Digest, ":") {
+			return ref, fmt.Errorf("invalid digest in image reference %q", name)
+		}
+	}
+	// A colon after the last slash separates the tag. Colons before it belong
+	// to the registry port.
+	if i := strings.LastIndex(name, ":"); i != -1 && i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	elems := strings.SplitN(name, "/", 2)
+	if len(elems) == 2 && (strings.ContainsAny(elems[0], ".:") || elems[0] == "localhost") {
+		ref.Registry = elems[0]
+		ref.Repository = elems[1]
+	} else {
+		ref.Registry = dockerHubRegistry
+		ref.Repository = name
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if ref.Repository == "" {
+		return ref, fmt.Errorf("missing repository in image reference %q", name)
+	}
+	return ref, nil
+}
+
+// Name returns the registry and repository, without tag or digest.
+func (r imageReference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// Reference returns the digest, if set, and the tag otherwise. It is used to
+// address manifests in the distribution API.
+func (r imageReference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r imageReference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// registryError is an error response returned by the distribution API.
+type registryError struct {
+	StatusCode int
+	Method     string
+	URL        string
+	Errors     []registryErrorDetail `json:"errors"`
+}
+
+type registryErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *registryError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("%s %s: unexpected status %d", e.Method, e.URL, e.StatusCode)
+	}
+	var details []string
+	for _, d := range e.Errors {
+		details = append(details, fmt.Sprintf("%s: %s", d.Code, d.Message))
+	}
+	return fmt.Sprintf("%s %s: status %d: %s", e.Method, e.URL, e.StatusCode, strings.Join(details, "; "))
+}
+
+// HasCode returns true if the registry returned any of the given error codes.
+func (e *registryError) HasCode(codes ...string) bool {
+	for _, d := range e.Errors {
+		for _, code := range codes {
+			if d.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNotFound returns true if err means that the repository, manifest, or blob
+// does not exist in the registry. Some registries reply with a bare 404 and no
+// error body, so the status code is taken into account as well.
+func isNotFound(err error) bool {
+	var regErr *registryError
+	if !errors.As(err, &regErr) {
+		return false
+	}
+	return regErr.StatusCode == http.StatusNotFound ||
+		regErr.HasCode(errorCodeNameUnknown, errorCodeManifestUnknown, errorCodeBlobUnknown)
+}
+
+// registryCredentials are used to log in to a registry.
+type registryCredentials struct {
+	Username string
+	Password string
+}
+
+// registryClient is a minimal client for the OCI distribution API. It
+// handles anonymous and token authentication, which covers every registry we
+// pull from and push to.
+// docs: https://github.com/opencontainers/distribution-spec/blob/main/spec.md
+type registryClient struct {
+	httpClient *http.Client
+	userAgent  string
+
+	mu sync.Mutex
+	// credentials is a map of registry host -> credentials.
+	credentials map[string]registryCredentials
+	// registryHTTPClients is a map of registry host -> client with
+	// registry-specific TLS configuration. Other registries use httpClient.
+	registryHTTPClients map[string]*http.Client
+	// authorizations is a map of host+scope -> `Authorization` header value.
+	authorizations map[string]string
+	// uploadChunkSize is the size of chunks of blobs, which registries
+	// reject as too large for a single request.
+	uploadChunkSize int
+}
+
+func newRegistryClient() *registryClient {
+	return &registryClient{
+		httpClient:          &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+		userAgent:           "giantswarm/retagger",
+		credentials:         loadRegistryCredentials(),
+		registryHTTPClients: map[string]*http.Client{},
+		authorizations:      map[string]string{},
+		uploadChunkSize:     defaultUploadChunkSize,
+	}
+}
+
+// SetCredentials replaces credentials of the registry, e.g. with credentials
+// defined in a skopeo file.
+func (c *registryClient) SetCredentials(registry string, creds registryCredentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credentials[normalizeRegistryHost(registry)] = creds
+}
+
+// SetTLSConfig sets the TLS configuration used for requests to the registry,
+// including token requests of its authentication challenges.
+func (c *registryClient) SetTLSConfig(registry string, config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registryHTTPClients[normalizeRegistryHost(registry)] = &http.Client{Transport: transport}
+}
+
+// httpClientFor returns the HTTP client used for requests to the registry.
+func (c *registryClient) httpClientFor(registry string) *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.registryHTTPClients[registry]; ok {
+		return client
+	}
+	return c.httpClient
+}
+
+// ListTags returns all tags of the repository, following `Link` pagination.
+// The returned error can be checked with isNotFound if the repository does
+// not exist.
+func (c *registryClient) ListTags(ctx context.Context, ref imageReference) ([]string, error) {
+	tags := []string{}
+	next := c.url(ref.Registry, "/v2/"+ref.Repository+"/tags/list?n=1000")
+	for next != "" {
+		resp, err := c.do(ctx, ref.Registry, pullScope(ref), func() (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding tag list of %q: %w", ref.Name(), err)
+		}
+		tags = append(tags, page.Tags...)
+
+		next = ""
+		if m := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			u, err := resp.Request.URL.Parse(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing next page link %q: %w", m[1], err)
+			}
+			next = u.String()
+		}
+	}
+	return tags, nil
+}
+
+// GetManifest returns the raw manifest, its media type and digest. The raw
+// bytes must be pushed unchanged to preserve the digest.
+func (c *registryClient) GetManifest(ctx context.Context, ref imageReference) ([]byte, string, string, error) {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/manifests/"+ref.Reference())
+	resp, err := c.do(ctx, ref.Registry, pullScope(ref), func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error reading manifest of %q: %w", ref, err)
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if m, err := parseManifest(b); err == nil && m.MediaType != "" {
+		mediaType = m.MediaType
+	}
+	return b, mediaType, digestOf(b), nil
+}
+
+// HeadManifest returns the digest of the manifest without downloading it.
+// Registries, which do not return the Docker-Content-Digest header, fall back
+// to GetManifest.
+func (c *registryClient) HeadManifest(ctx context.Context, ref imageReference) (string, error) {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/manifests/"+ref.Reference())
+	resp, err := c.do(ctx, ref.Registry, pullScope(ref), func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	_, _, digest, err := c.GetManifest(ctx, ref)
+	return digest, err
+}
+
+// PutManifest pushes the raw manifest under ref's tag or digest.
+func (c *registryClient) PutManifest(ctx context.Context, ref imageReference, mediaType string, b []byte) error {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/manifests/"+ref.Reference())
+	resp, err := c.do(ctx, ref.Registry, pushScope(ref), func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// BlobExists returns true if the blob is present in the repository.
+func (c *registryClient) BlobExists(ctx context.Context, ref imageReference, digest string) (bool, error) {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/blobs/"+digest)
+	resp, err := c.do(ctx, ref.Registry, pullScope(ref), func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	})
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	return true, nil
+}
+
+// GetBlob returns a reader of the blob's content. The caller has to close it.
+func (c *registryClient) GetBlob(ctx context.Context, ref imageReference, digest string) (io.ReadCloser, error) {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/blobs/"+digest)
+	resp, err := c.do(ctx, ref.Registry, pullScope(ref), func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// MountBlob attempts to mount the blob from another repository in the same
+// registry, which avoids uploading it again. It returns false if the registry
+// refused to mount the blob.
+func (c *registryClient) MountBlob(ctx context.Context, ref imageReference, digest, fromRepository string) (bool, error) {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/blobs/uploads/?mount="+url.QueryEscape(digest)+"&from="+url.QueryEscape(fromRepository))
+	scopes := append(pushScope(ref), fmt.Sprintf("repository:%s:pull", fromRepository))
+	resp, err := c.do(ctx, ref.Registry, scopes, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	// 202 Accepted means the registry started a regular upload session
+	// instead. It is abandoned and will be garbage collected.
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// UploadBlob pushes the blob in a single request. Registries rejecting it as
+// too large get the blob in chunks instead. newBody is called for every
+// attempt, so it has to return a reader positioned at the start of the blob.
+func (c *registryClient) UploadBlob(ctx context.Context, ref imageReference, digest string, size int64, newBody func() (io.ReadCloser, error)) error {
+	location, err := c.startUpload(ctx, ref, digest)
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	resp, err := c.do(ctx, ref.Registry, pushScope(ref), func() (*http.Request, error) {
+		body, err := newBody()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, location.String(), body)
+		if err != nil {
+			_ = body.Close()
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	var regErr *registryError
+	if errors.As(err, &regErr) && regErr.StatusCode == http.StatusRequestEntityTooLarge {
+		return c.uploadBlobChunks(ctx, ref, digest, newBody)
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading %q to %q: %w", digest, ref.Name(), err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// uploadBlobChunks pushes the blob in a new upload session, in PATCH requests
+// of at most uploadChunkSize bytes, and completes it with an empty PUT.
+// docs: https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-a-blob-in-chunks
+func (c *registryClient) uploadBlobChunks(ctx context.Context, ref imageReference, digest string, newBody func() (io.ReadCloser, error)) error {
+	location, err := c.startUpload(ctx, ref, digest)
+	if err != nil {
+		return err
+	}
+	body, err := newBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	chunk := make([]byte, c.uploadChunkSize)
+	var offset int64
+	for {
+		n, readErr := io.ReadFull(body, chunk)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("error reading %q: %w", digest, readErr)
+		}
+		if n == 0 {
+			break
+		}
+		contentRange := fmt.Sprintf("%d-%d", offset, offset+int64(n)-1)
+		resp, err := c.do(ctx, ref.Registry, pushScope(ref), func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location.String(), bytes.NewReader(chunk[:n]))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", contentRange)
+			return req, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error uploading bytes %s of %q to %q: %w", contentRange, digest, ref.Name(), err)
+		}
+		_ = resp.Body.Close()
+		location, err = uploadLocation(resp)
+		if err != nil {
+			return fmt.Errorf("error uploading %q to %q: %w", digest, ref.Name(), err)
+		}
+		offset += int64(n)
+		if readErr != nil {
+			break
+		}
+	}
+
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	resp, err := c.do(ctx, ref.Registry, pushScope(ref), func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPut, location.String(), nil)
+	})
+	if err != nil {
+		return fmt.Errorf("error completing upload of %q to %q: %w", digest, ref.Name(), err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// startUpload starts an upload session and returns its location.
+func (c *registryClient) startUpload(ctx context.Context, ref imageReference, digest string) (*url.URL, error) {
+	u := c.url(ref.Registry, "/v2/"+ref.Repository+"/blobs/uploads/")
+	resp, err := c.do(ctx, ref.Registry, pushScope(ref), func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error starting upload of %q to %q: %w", digest, ref.Name(), err)
+	}
+	_ = resp.Body.Close()
+	location, err := uploadLocation(resp)
+	if err != nil {
+		return nil, fmt.Errorf("error starting upload of %q to %q: %w", digest, ref.Name(), err)
+	}
+	return location, nil
+}
+
+// uploadLocation returns the URL the upload session continues at, which every
+// response of the session carries in `Location`.
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return nil, fmt.Errorf("registry returned invalid upload location %q", resp.Header.Get("Location"))
+	}
+	return location, nil
+}
+
+// url returns the API URL for the path in the given registry. Local registries
+// are reached over plain HTTP, which allows testing against an in-memory
+// registry.
+func (c *registryClient) url(registry, path string) string {
+	host := registry
+	if host == dockerHubRegistry {
+		host = dockerHubAPIRegistry
+	}
+	scheme := "https"
+	if h := strings.Split(host, ":")[0]; h == "localhost" || h == "127.0.0.1" {
+		scheme = "http"
+	}
+	return scheme + "://" + host + path
+}
+
+// do sends the request built by newRequest, authenticating when the registry
+// asks for it. Throttled requests are sent again after the delay asked for in
+// `Retry-After`, or after an exponential backoff. newRequest may be called more
+// than once, so it must return a fresh request with a fresh body each time.
+// Responses with status codes other than 2xx are converted to *registryError.
+func (c *registryClient) do(ctx context.Context, registry string, scopes []string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	authKey := registry + " " + strings.Join(scopes, " ")
+
+	authenticated := false
+	throttled := 0
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		c.mu.Lock()
+		authorization := c.authorizations[authKey]
+		c.mu.Unlock()
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := c.httpClientFor(registry).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && !authenticated:
+			challenge := resp.Header.Get("WWW-Authenticate")
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			authorization, err := c.authorize(ctx, registry, scopes, challenge)
+			if err != nil {
+				return nil, err
+			}
+			c.mu.Lock()
+			c.authorizations[authKey] = authorization
+			c.mu.Unlock()
+			authenticated = true
+		case resp.StatusCode == http.StatusTooManyRequests && throttled < maxThrottledRetries:
+			delay := retryAfter(resp.Header.Get("Retry-After"), backoffDelay(throttled))
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			throttled++
+			logStdErr.Debugf("registry %q throttled %s %s, retrying in %s", registry, req.Method, req.URL.Redacted(), delay)
+			if err := sleep(ctx, delay); err != nil {
+				return nil, err
+			}
+		case resp.StatusCode < 200 || resp.StatusCode > 299:
+			return nil, newRegistryError(resp)
+		default:
+			return resp, nil
+		}
+	}
+}
+
+// backoffDelay returns the delay before the retry following the given number
+// of failed attempts.
+// Example: 0 -> 1s, 1 -> 2s, 2 -> 4s
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBackoff << attempt
+	if delay > maxRetryDelay || delay <= 0 {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// retryAfter returns the delay asked for in a `Retry-After` header, which is
+// either a number of seconds or an HTTP date, or fallback if it is missing.
+// docs: https://www.rfc-editor.org/rfc/rfc9110#field.retry-after
+func retryAfter(header string, fallback time.Duration) time.Duration {
+	delay := fallback
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	}
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// sleep waits for the duration, unless ctx is canceled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// authorize returns an `Authorization` header value satisfying the
+// `WWW-Authenticate` challenge.
+// docs: https://distribution.github.io/distribution/spec/auth/token/
+func (c *registryClient) authorize(ctx context.Context, registry string, scopes []string, challenge string) (string, error) {
+	c.mu.Lock()
+	creds, hasCreds := c.credentials[registry]
+	c.mu.Unlock()
+
+	scheme, _, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCreds {
+			return "", fmt.Errorf("registry %q requires basic authentication, but no credentials were found", registry)
+		}
+		return "Basic " + basicAuth(creds), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("registry %q responded with unsupported authentication challenge %q", registry, challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry %q responded with invalid realm in challenge %q", registry, challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if hasCreds {
+		req.Header.Set("Authorization", "Basic "+basicAuth(creds))
+	}
+	resp, err := c.httpClientFor(registry).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting token for %q: %w", registry, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newRegistryError(resp)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error decoding token for %q: %w", registry, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("registry %q returned an empty token", registry)
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// newRegistryError reads and closes the response body.
+func newRegistryError(resp *http.Response) error {
+	defer resp.Body.Close()
+	regErr := &registryError{
+		StatusCode: resp.StatusCode,
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.Redacted(),
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	_ = json.Unmarshal(b, regErr)
+	return regErr
+}
+
+// pullScope returns the token scope needed to read from the repository.
+func pullScope(ref imageReference) []string {
+	return []string{fmt.Sprintf("repository:%s:pull", ref.Repository)}
+}
+
+// pushScope returns the token scope needed to write to the repository.
+func pushScope(ref imageReference) []string {
+	return []string{fmt.Sprintf("repository:%s:pull,push", ref.Repository)}
+}
+
+func basicAuth(creds registryCredentials) string {
+	return base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+}
+
+// registryAuthFiles returns the paths of files written by `skopeo login` and
+// `docker login`, in the order of precedence.
+func registryAuthFiles() []string {
+	var files []string
+	if f := os.Getenv("REGISTRY_AUTH_FILE"); f != "" {
+		files = append(files, f)
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "containers", "auth.json"))
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(dir, "containers", "auth.json"))
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		files = append(files, filepath.Join(dir, "config.json"))
+	} else if dir, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(dir, ".docker", "config.json"))
+	}
+	return files
+}
+
+// loadRegistryCredentials reads credentials stored by `skopeo login` and
+// `docker login`. Credential helpers are not supported.
+func loadRegistryCredentials() map[string]registryCredentials {
+	credentials := map[string]registryCredentials{}
+
+	files := registryAuthFiles()
+	// Iterate in reverse, so files with higher precedence overwrite entries.
+	for i := len(files) - 1; i >= 0; i-- {
+		b, err := os.ReadFile(files[i])
+		if err != nil {
+			continue
+		}
+		var authFile struct {
+			Auths map[string]struct {
+				Auth string `json:"auth"`
+			} `json:"auths"`
+		}
+		if err := json.Unmarshal(b, &authFile); err != nil {
+			logStdErr.Warnf("error parsing registry auth file %q: %v", files[i], err)
+			continue
+		}
+		for host, entry := range authFile.Auths {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				continue
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				continue
+			}
+			credentials[normalizeRegistryHost(host)] = registryCredentials{
+				Username: username,
+				Password: password,
+			}
+		}
+	}
+	return credentials
+}
+
+// normalizeRegistryHost converts keys used in auth files to registry hosts.
+// Example: "https://index.docker.io/v1/" -> "docker.io"
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", dockerHubAPIRegistry:
+		return dockerHubRegistry
+	}
+	return host
+}
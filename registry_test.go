@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRegistry is an in-memory registry serving the parts of the
+// distribution API used by registryClient and imageCopier.
+type testRegistry struct {
+	server *httptest.Server
+
+	// auth is "", "basic", or "bearer".
+	auth     string
+	username string
+	password string
+	// pageSize limits the number of tags per page of tag lists, if not 0.
+	pageSize int
+	// throttled is the number of requests answered with 429 Too Many
+	// Requests before requests are served again.
+	throttled  int
+	retryAfter string
+	// maxUploadSize rejects requests uploading more bytes at once with 413
+	// Request Entity Too Large, if not 0.
+	maxUploadSize int
+
+	mu sync.Mutex
+	// manifests is a map of repository -> tag or digest -> manifest.
+	manifests map[string]map[string]testManifest
+	// blobs is a map of repository -> digest -> content.
+	blobs map[string]map[string][]byte
+	// requests counts requests by kind, e.g. "upload", "mount", or "blob".
+	requests map[string]int
+	uploads  int
+	// sessions is a map of upload session -> content uploaded in chunks.
+	sessions map[string][]byte
+}
+
+type testManifest struct {
+	mediaType string
+	body      []byte
+}
+
+var testRegistryPathPattern = regexp.MustCompile(`^/v2/(.+)/(tags/list|manifests/[^/]+|blobs/uploads/[^/]*|blobs/[^/]+)$`)
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	r := &testRegistry{
+		manifests: map[string]map[string]testManifest{},
+		blobs:     map[string]map[string][]byte{},
+		requests:  map[string]int{},
+		sessions:  map[string][]byte{},
+	}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// newTestClient returns a registry client without credentials of the user
+// running the tests.
+func newTestClient() *registryClient {
+	c := newRegistryClient()
+	c.credentials = map[string]registryCredentials{}
+	return c
+}
+
+// host returns the registry host, which is reached over plain HTTP.
+// Example: "127.0.0.1:41234"
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) count(kind string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests[kind]
+}
+
+func (r *testRegistry) hasManifest(repository, reference string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.manifests[repository][reference]
+	return ok
+}
+
+// putBlob stores the content in the repository and returns its descriptor.
+func (r *testRegistry) putBlob(repository, mediaType string, content []byte) descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = map[string][]byte{}
+	}
+	r.blobs[repository][digestOf(content)] = content
+	return descriptor{MediaType: mediaType, Digest: digestOf(content), Size: int64(len(content))}
+}
+
+// putManifest stores the manifest under the tag, if not empty, and its
+// digest, and returns its descriptor.
+func (r *testRegistry) putManifest(repository, tag, mediaType string, v interface{}) descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]testManifest{}
+	}
+	m := testManifest{mediaType: mediaType, body: b}
+	r.manifests[repository][digestOf(b)] = m
+	if tag != "" {
+		r.manifests[repository][tag] = m
+	}
+	return descriptor{MediaType: mediaType, Digest: digestOf(b), Size: int64(len(b))}
+}
+
+// putImage stores a single-platform image with a layer shared by all images
+// and a layer specific to the architecture.
+func (r *testRegistry) putImage(repository, tag, architecture string) descriptor {
+	config := r.putBlob(repository, "application/vnd.oci.image.config.v1+json", []byte(fmt.Sprintf(`{"architecture":%q,"os":"linux"}`, architecture)))
+	shared := r.putBlob(repository, "application/vnd.oci.image.layer.v1.tar+gzip", []byte("shared layer"))
+	layer := r.putBlob(repository, "application/vnd.oci.image.layer.v1.tar+gzip", []byte("layer of "+architecture))
+	return r.putManifest(repository, tag, mediaTypeOCIManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"config":        config,
+		"layers":        []descriptor{shared, layer},
+	})
+}
+
+// putIndex stores an index of images of the architectures.
+func (r *testRegistry) putIndex(repository, tag string, architectures ...string) descriptor {
+	var manifests []descriptor
+	for _, architecture := range architectures {
+		d := r.putImage(repository, "", architecture)
+		d.Platform = &platform{OS: "linux", Architecture: architecture}
+		manifests = append(manifests, d)
+	}
+	return r.putManifest(repository, tag, mediaTypeOCIIndex, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIIndex,
+		"manifests":     manifests,
+	})
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		if r.username != "" {
+			if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		r.requests["token"]++
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "test-token"})
+		return
+	}
+	switch r.auth {
+	case "basic":
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case "bearer":
+		if req.Header.Get("Authorization") != "Bearer test-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.throttled > 0 {
+		r.throttled--
+		r.requests["throttled"]++
+		if r.retryAfter != "" {
+			w.Header().Set("Retry-After", r.retryAfter)
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	m := testRegistryPathPattern.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		writeTestError(w, http.StatusNotFound, "")
+		return
+	}
+	repository, endpoint := m[1], m[2]
+	switch {
+	case endpoint == "tags/list":
+		r.serveTags(w, req, repository)
+	case strings.HasPrefix(endpoint, "manifests/"):
+		r.serveManifest(w, req, repository, strings.TrimPrefix(endpoint, "manifests/"))
+	case strings.HasPrefix(endpoint, "blobs/uploads/"):
+		r.serveUpload(w, req, repository, strings.TrimPrefix(endpoint, "blobs/uploads/"))
+	default:
+		r.serveBlob(w, req, repository, strings.TrimPrefix(endpoint, "blobs/"))
+	}
+}
+
+func (r *testRegistry) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	r.requests["tags"]++
+	if r.manifests[repository] == nil {
+		writeTestError(w, http.StatusNotFound, errorCodeNameUnknown)
+		return
+	}
+	var tags []string
+	for reference := range r.manifests[repository] {
+		if !strings.Contains(reference, ":") && reference > req.URL.Query().Get("last") {
+			tags = append(tags, reference)
+		}
+	}
+	sort.Strings(tags)
+	if r.pageSize > 0 && len(tags) > r.pageSize {
+		tags = tags[:r.pageSize]
+		next := fmt.Sprintf("/v2/%s/tags/list?n=%d&last=%s", repository, r.pageSize, tags[len(tags)-1])
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	if req.Method == http.MethodPut {
+		r.requests["put manifest"]++
+		b, _ := io.ReadAll(req.Body)
+		if missing := r.missingReferences(repository, b); missing != "" {
+			writeTestError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN")
+			return
+		}
+		if r.manifests[repository] == nil {
+			r.manifests[repository] = map[string]testManifest{}
+		}
+		m := testManifest{mediaType: req.Header.Get("Content-Type"), body: b}
+		r.manifests[repository][digestOf(b)] = m
+		r.manifests[repository][reference] = m
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if r.manifests[repository] == nil {
+		writeTestError(w, http.StatusNotFound, errorCodeNameUnknown)
+		return
+	}
+	m, ok := r.manifests[repository][reference]
+	if !ok {
+		writeTestError(w, http.StatusNotFound, errorCodeManifestUnknown)
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", digestOf(m.body))
+	if req.Method == http.MethodGet {
+		r.requests["manifest"]++
+		_, _ = w.Write(m.body)
+	}
+}
+
+// missingReferences returns a digest referenced by the manifest, which does
+// not exist in the repository, like registries validating pushed manifests.
+func (r *testRegistry) missingReferences(repository string, b []byte) string {
+	m, err := parseManifest(b)
+	if err != nil {
+		return "invalid"
+	}
+	for _, d := range m.Manifests {
+		if _, ok := r.manifests[repository][d.Digest]; !ok {
+			return d.Digest
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, d := range blobs {
+		if _, ok := r.blobs[repository][d.Digest]; !ok {
+			return d.Digest
+		}
+	}
+	return ""
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository, session string) {
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = map[string][]byte{}
+	}
+	switch req.Method {
+	case http.MethodPost:
+		query := req.URL.Query()
+		if digest := query.Get("mount"); digest != "" {
+			if content, ok := r.blobs[query.Get("from")][digest]; ok {
+				r.requests["mount"]++
+				r.blobs[repository][digest] = content
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		chunk, _ := io.ReadAll(req.Body)
+		if r.maxUploadSize > 0 && len(chunk) > r.maxUploadSize {
+			writeTestError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID")
+			return
+		}
+		start := len(r.sessions[session])
+		if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", start, start+len(chunk)-1) {
+			writeTestError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID")
+			return
+		}
+		r.requests["chunk"]++
+		r.sessions[session] = append(r.sessions[session], chunk...)
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		if r.maxUploadSize > 0 && len(body) > r.maxUploadSize {
+			writeTestError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID")
+			return
+		}
+		content := append(r.sessions[session], body...)
+		delete(r.sessions, session)
+		digest := req.URL.Query().Get("digest")
+		if session == "" || digest != digestOf(content) {
+			writeTestError(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		r.requests["upload"]++
+		r.blobs[repository][digest] = content
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *testRegistry) serveBlob(w http.ResponseWriter, req *http.Request, repository, digest string) {
+	content, ok := r.blobs[repository][digest]
+	if !ok {
+		writeTestError(w, http.StatusNotFound, errorCodeBlobUnknown)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	if req.Method == http.MethodGet {
+		r.requests["blob"]++
+		_, _ = w.Write(content)
+	}
+}
+
+func writeTestError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if code != "" {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": []registryErrorDetail{{Code: code, Message: strings.ToLower(code)}},
+		})
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected imageReference
+	}{
+		{"alpine", imageReference{Registry: "docker.io", Repository: "library/alpine"}},
+		{"alpine:3.19", imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.19"}},
+		{"docker://giantswarm/app-operator:1.0", imageReference{Registry: "docker.io", Repository: "giantswarm/app-operator", Tag: "1.0"}},
+		{"quay.io/cilium/cilium:v1.15.0", imageReference{Registry: "quay.io", Repository: "cilium/cilium", Tag: "v1.15.0"}},
+		{"localhost:5000/foo@sha256:abc", imageReference{Registry: "localhost:5000", Repository: "foo", Digest: "sha256:abc"}},
+		{"localhost/foo:1", imageReference{Registry: "localhost", Repository: "foo", Tag: "1"}},
+	}
+	for _, tc := range testCases {
+		ref, err := parseReference(tc.name)
+		if err != nil {
+			t.Errorf("parseReference(%q) returned error: %v", tc.name, err)
+			continue
+		}
+		if ref != tc.expected {
+			t.Errorf("parseReference(%q) = %#v, expected %#v", tc.name, ref, tc.expected)
+		}
+	}
+
+	for _, name := range []string{"", "foo@sha256", "quay.io/"} {
+		if _, err := parseReference(name); err == nil {
+			t.Errorf("parseReference(%q) returned no error", name)
+		}
+	}
+}
+
+func TestRegistryClientURL(t *testing.T) {
+	testCases := []struct {
+		registry string
+		expected string
+	}{
+		{"localhost:5000", "http://localhost:5000/v2/"},
+		{"127.0.0.1:5000", "http://127.0.0.1:5000/v2/"},
+		{"localhost", "http://localhost/v2/"},
+		{"quay.io", "https://quay.io/v2/"},
+		{"docker.io", "https://registry-1.docker.io/v2/"},
+	}
+	c := newTestClient()
+	for _, tc := range testCases {
+		if u := c.url(tc.registry, "/v2/"); u != tc.expected {
+			t.Errorf("url(%q) = %q, expected %q", tc.registry, u, tc.expected)
+		}
+	}
+}
+
+func TestRegistryClientListTags(t *testing.T) {
+	r := newTestRegistry(t)
+	r.pageSize = 2
+	var expected []string
+	for i := 0; i < 5; i++ {
+		tag := fmt.Sprintf("v1.%d", i)
+		r.putImage("foo/bar", tag, "amd64")
+		expected = append(expected, tag)
+	}
+
+	tags, err := newTestClient().ListTags(context.Background(), imageReference{Registry: r.host(), Repository: "foo/bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != strings.Join(expected, ",") {
+		t.Errorf("got tags %v, expected %v", tags, expected)
+	}
+	if n := r.count("tags"); n != 3 {
+		t.Errorf("got %d tag list requests, expected 3 pages", n)
+	}
+}
+
+func TestRegistryClientAuth(t *testing.T) {
+	testCases := []struct {
+		name        string
+		auth        string
+		username    string
+		credentials *registryCredentials
+		expectErr   bool
+	}{
+		{name: "anonymous token", auth: "bearer"},
+		{name: "token with credentials", auth: "bearer", username: "user", credentials: &registryCredentials{Username: "user", Password: "secret"}},
+		{name: "token with wrong credentials", auth: "bearer", username: "user", credentials: &registryCredentials{Username: "user", Password: "wrong"}, expectErr: true},
+		{name: "basic", auth: "basic", username: "user", credentials: &registryCredentials{Username: "user", Password: "secret"}},
+		{name: "basic without credentials", auth: "basic", username: "user", expectErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			r.auth = tc.auth
+			r.username = tc.username
+			r.password = "secret"
+			r.putImage("foo", "1.0", "amd64")
+
+			c := newTestClient()
+			if tc.credentials != nil {
+				c.SetCredentials(r.host(), *tc.credentials)
+			}
+			ref := imageReference{Registry: r.host(), Repository: "foo"}
+			for i := 0; i < 2; i++ {
+				tags, err := c.ListTags(context.Background(), ref)
+				if tc.expectErr {
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tags) != 1 || tags[0] != "1.0" {
+					t.Errorf("got tags %v, expected [1.0]", tags)
+				}
+			}
+			// The token is reused for the second request.
+			if tc.auth == "bearer" && r.count("token") != 1 {
+				t.Errorf("got %d token requests, expected 1", r.count("token"))
+			}
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	r := newTestRegistry(t)
+	r.putImage("foo", "1.0", "amd64")
+	c := newTestClient()
+	ctx := context.Background()
+
+	_, err := c.ListTags(ctx, imageReference{Registry: r.host(), Repository: "unknown"})
+	if !isNotFound(err) {
+		t.Errorf("expected listing an unknown repository to be not found, got %v", err)
+	}
+	_, _, _, err = c.GetManifest(ctx, imageReference{Registry: r.host(), Repository: "foo", Tag: "2.0"})
+	if !isNotFound(err) {
+		t.Errorf("expected getting an unknown tag to be not found, got %v", err)
+	}
+	exists, err := c.BlobExists(ctx, imageReference{Registry: r.host(), Repository: "foo"}, digestOf([]byte("unknown")))
+	if exists || err != nil {
+		t.Errorf("expected unknown blob not to exist, got %t, %v", exists, err)
+	}
+
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"NAME_UNKNOWN", &registryError{StatusCode: http.StatusBadRequest, Errors: []registryErrorDetail{{Code: errorCodeNameUnknown}}}, true},
+		{"MANIFEST_UNKNOWN", &registryError{StatusCode: http.StatusBadRequest, Errors: []registryErrorDetail{{Code: errorCodeManifestUnknown}}}, true},
+		{"bare 404", &registryError{StatusCode: http.StatusNotFound}, true},
+		{"DENIED", &registryError{StatusCode: http.StatusForbidden, Errors: []registryErrorDetail{{Code: "DENIED"}}}, false},
+		{"wrapped", fmt.Errorf("error: %w", &registryError{StatusCode: http.StatusNotFound}), true},
+		{"other error", fmt.Errorf("connection refused"), false},
+	}
+	for _, tc := range testCases {
+		if isNotFound(tc.err) != tc.expected {
+			t.Errorf("isNotFound(%s) = %t, expected %t", tc.name, !tc.expected, tc.expected)
+		}
+	}
+}
+
+func TestLoadRegistryCredentials(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", dir)
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	config := fmt.Sprintf(`{"auths":{"https://index.docker.io/v1/":{"auth":%q}}}`, auth)
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := loadRegistryCredentials()
+	if creds := credentials["docker.io"]; creds.Username != "user" || creds.Password != "secret" {
+		t.Errorf("got credentials %v for docker.io, expected user:secret", credentials)
+	}
+}
+
+func TestRegistryClientThrottling(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	r := newTestRegistry(t)
+	r.putImage("foo", "1.0", "amd64")
+	ref := imageReference{Registry: r.host(), Repository: "foo", Tag: "1.0"}
+	c := newTestClient()
+
+	r.throttled = 2
+	r.retryAfter = "0"
+	if _, err := c.HeadManifest(context.Background(), ref); err != nil {
+		t.Fatalf("expected throttled requests to be retried, got %v", err)
+	}
+	if n := r.count("throttled"); n != 2 {
+		t.Errorf("got %d throttled requests, expected 2", n)
+	}
+
+	r.throttled = maxThrottledRetries + 1
+	r.retryAfter = ""
+	_, err := c.HeadManifest(context.Background(), ref)
+	var regErr *registryError
+	if !errors.As(err, &regErr) || regErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 after %d retries, got %v", maxThrottledRetries, err)
+	}
+}
+
+func TestRegistryClientUploadBlobChunks(t *testing.T) {
+	r := newTestRegistry(t)
+	r.auth = "bearer"
+	r.maxUploadSize = 10
+	content := []byte("a blob larger than the upload limit")
+
+	c := newTestClient()
+	c.uploadChunkSize = 8
+	ref := imageReference{Registry: r.host(), Repository: "foo/bar"}
+	err := c.UploadBlob(context.Background(), ref, digestOf(content), int64(len(content)), func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(string(content))), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.count("chunk"); n != 5 {
+		t.Errorf("got %d chunks, expected 5", n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if uploaded := r.blobs["foo/bar"][digestOf(content)]; string(uploaded) != string(content) {
+		t.Errorf("got blob %q, expected %q", uploaded, content)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 3 * time.Second},
+		{"invalid", 3 * time.Second},
+		{"0", 0},
+		{"10", 10 * time.Second},
+		{"86400", maxRetryDelay},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tc := range testCases {
+		if delay := retryAfter(tc.header, 3*time.Second); delay != tc.expected {
+			t.Errorf("retryAfter(%q) = %s, expected %s", tc.header, delay, tc.expected)
+		}
+	}
+
+	if delay := backoffDelay(2); delay != 4*retryBackoff {
+		t.Errorf("backoffDelay(2) = %s, expected %s", delay, 4*retryBackoff)
+	}
+	if delay := backoffDelay(100); delay != maxRetryDelay {
+		t.Errorf("backoffDelay(100) = %s, expected %s", delay, maxRetryDelay)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	copyStatusCopied = "copied"
+	copyStatusFailed = "failed"
+)
+
+// report is a machine-readable summary of a `retagger run` invocation.
+type report struct {
+	// Command is "run".
+	Command string `json:"command"`
+	// File is the images file that was processed.
+	File string `json:"file"`
+	// Destinations are the names of all configured destinations.
+	Destinations []string `json:"destinations"`
+	// StartedAt is the time the command started.
+	StartedAt time.Time `json:"startedAt"`
+	// DurationSeconds is the time the command took.
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Images contains one entry per processed image definition.
+	Images []reportImage `json:"images"`
+}
+
+type reportImage struct {
+	// Image is the source image name.
+	Image string `json:"image"`
+	// Key identifies the image definition. It is used to retry failed images.
+	Key string `json:"key,omitempty"`
+	// ShardKey identifies the image for sharding. It is used to weight shards
+	// of later runs.
+	ShardKey string `json:"shardKey,omitempty"`
+	// MatchedTags are tags matched by the image definition's filters.
+	MatchedTags []string `json:"matchedTags"`
+	// SkippedTags are matched tags, which are already present in all
+	// destinations.
+	SkippedTags []string `json:"skippedTags"`
+	// NormalizedTags is a map of source tag -> destination tag of tags, in
+	// which characters invalid in tags were replaced.
+	NormalizedTags map[string]string `json:"normalizedTags,omitempty"`
+	// Error is set if the image could not be processed at all.
+	Error string `json:"error,omitempty"`
+	// Copies contains one entry per tag and destination.
+	Copies []reportCopy `json:"copies"`
+}
+
+type reportCopy struct {
+	// Destination is the destination name.
+	Destination string `json:"destination"`
+	// Source is the source image reference.
+	Source string `json:"source"`
+	// Target is the destination image reference.
+	Target string `json:"target"`
+	// Tag is the destination tag.
+	Tag string `json:"tag"`
+	// Status is either "copied" or "failed".
+	Status string `json:"status"`
+	// Digest is the digest of the copied manifest.
+	Digest string `json:"digest,omitempty"`
+	// Error is set when Status is "failed".
+	Error string `json:"error,omitempty"`
+	// DurationSeconds is the time spent copying.
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Mutable is true if the tag matches the mutable tag policy.
+	Mutable bool `json:"mutable,omitempty"`
+	// PreviousDigest is the digest the mutable tag pointed to in the
+	// destination before the copy.
+	PreviousDigest string `json:"previousDigest,omitempty"`
+	// DigestChanged is true if the mutable tag moved to a different manifest.
+	DigestChanged bool `json:"digestChanged,omitempty"`
+}
+
+func newReport(command, file string) *report {
+	r := &report{
+		Command:   command,
+		File:      file,
+		StartedAt: time.Now(),
+		Images:    []reportImage{},
+	}
+	for _, d := range destinations {
+		r.Destinations = append(r.Destinations, d.Name)
+	}
+	return r
+}
+
+// AddImage adds the result of processing a single image definition.
+func (r *report) AddImage(result imageResult, err error) {
+	image := reportImage{
+		Image:          result.Image,
+		Key:            result.Key,
+		ShardKey:       result.ShardKey,
+		MatchedTags:    emptyIfNil(result.MatchedTags),
+		SkippedTags:    emptyIfNil(result.SkippedTags),
+		NormalizedTags: result.NormalizedTags,
+		Copies:         []reportCopy{},
+	}
+	if err != nil {
+		image.Error = err.Error()
+	}
+	for _, c := range result.Results {
+		rc := reportCopy{
+			Destination:     c.DestinationName,
+			Source:          c.Source,
+			Target:          c.Destination,
+			Tag:             c.Tag,
+			Status:          copyStatusCopied,
+			Digest:          c.Digest,
+			DurationSeconds: c.Duration.Seconds(),
+			Mutable:         c.Mutable,
+			PreviousDigest:  c.PreviousDigest,
+			DigestChanged:   c.DigestChanged(),
+		}
+		if c.Err != nil {
+			rc.Status = copyStatusFailed
+			rc.Error = c.Err.Error()
+		}
+		image.Copies = append(image.Copies, rc)
+	}
+	r.Images = append(r.Images, image)
+}
+
+// Write saves the report to files requested with --report-json and
+// --report-junit flags.
+func (r *report) Write() error {
+	r.DurationSeconds = time.Since(r.StartedAt).Seconds()
+
+	if flagReportJSON != "" {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshaling JSON report: %w", err)
+		}
+		if err := os.WriteFile(flagReportJSON, b, 0600); err != nil {
+			return fmt.Errorf("error writing JSON report: %w", err)
+		}
+	}
+
+	if flagReportJUnit != "" {
+		b, err := xml.MarshalIndent(r.junit(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshaling JUnit report: %w", err)
+		}
+		b = append([]byte(xml.Header), b...)
+		if err := os.WriteFile(flagReportJUnit, b, 0600); err != nil {
+			return fmt.Errorf("error writing JUnit report: %w", err)
+		}
+	}
+	return nil
+}
+
+// junitTestSuites follows the JUnit XML format understood by CircleCI.
+// docs: https://circleci.com/docs/collect-test-data/
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// junit converts the report to JUnit format. Every image definition is a test
+// case, which fails if the image could not be processed or any of its copies
+// failed.
+func (r *report) junit() junitTestSuites {
+	suite := junitTestSuite{
+		Name: fmt.Sprintf("retagger %s %s", r.Command, r.File),
+		Time: r.DurationSeconds,
+	}
+	for _, image := range r.Images {
+		tc := junitTestCase{
+			Name:      image.Image,
+			ClassName: r.File,
+		}
+		var problems []string
+		if image.Error != "" {
+			problems = append(problems, image.Error)
+		}
+		for _, c := range image.Copies {
+			tc.Time += c.DurationSeconds
+			if c.Status == copyStatusFailed {
+				problems = append(problems, fmt.Sprintf("%s -> %s: %s", c.Source, c.Target, c.Error))
+			}
+		}
+		if len(problems) > 0 {
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d problems", len(problems)),
+				Body:    strings.Join(problems, "\n"),
+			}
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	return junitTestSuites{Suites: []junitTestSuite{suite}}
+}
+
+func emptyIfNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// copyResult is the outcome of copying an image to a single destination.
+type copyResult struct {
+	// Source is the reference of the copied image.
+	// Example: "quay.io/cilium/cilium:v1.15.0"
+	Source string
+	// Destination is the reference the image was pushed to.
+	// Example: "gsoci.azurecr.io/giantswarm/cilium:v1.15.0"
+	Destination string
+	// DestinationName is the name of the destination.
+	// Example: "azure"
+	DestinationName string
+	// Tag is the tag pushed to the destination.
+	Tag string
+	// Digest is the digest of the copied manifest. It is empty if the copy
+	// failed before the manifest was fetched.
+	Digest string
+	// Err is nil if the copy succeeded.
+	Err error
+	// Duration is the time spent copying, including retries.
+	Duration time.Duration
+	// Mutable is true if the tag matches the mutable tag policy.
+	Mutable bool
+	// PreviousDigest is the digest of the destination tag before the copy.
+	// It is only resolved for mutable tags, and empty if the tag did not
+	// exist.
+	PreviousDigest string
+}
+
+// DigestChanged returns true if the copy moved an existing mutable tag to
+// a different manifest.
+func (r copyResult) DigestChanged() bool {
+	return r.Mutable && r.PreviousDigest != "" && r.Digest != "" && r.PreviousDigest != r.Digest
+}
+
+// imageResult aggregates copy results of a single image definition.
+type imageResult struct {
+	// Image is the name of the source image.
+	Image string
+	// Key identifies the image definition, see RenamedImage.Key.
+	Key string
+	// ShardKey identifies the image for sharding, see RenamedImage.ShardKey.
+	ShardKey string
+	// MatchedTags are source tags matching the image definition.
+	MatchedTags []string
+	// SkippedTags are matched tags already present in all destinations.
+	SkippedTags []string
+	// NormalizedTags is a map of source tag -> destination tag of tags, in
+	// which characters invalid in tags were replaced.
+	NormalizedTags map[string]string
+	// Results contains one entry per tag and destination.
+	Results []copyResult
+}
+
+// Failed returns results of copies which did not succeed.
+func (r imageResult) Failed() []copyResult {
+	var failed []copyResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// shardOverload is how much heavier than the average a shard can get, before
+// entries spill over to other shards.
+const shardOverload = 0.1
+
+// Key identifies the image definition in reports and checkpoints. It does not
+// depend on the entry's position in the file. It ends
+// with a hash of the whole entry, so entries differing only in options like
+// destination_tag or platforms get different keys, and --resume does not
+// skip one of them as completed.
+// Example: "quay.io/cilium/cilium semver=>= v1.15 entry=0123456789ab"
+func (img *RenamedImage) Key() string {
+	parts := []string{img.Image}
+	for _, option := range []struct{ name, value string }{
+		{"tag_or_pattern", img.TagOrPattern},
+		{"sha", img.SHA},
+		{"semver", img.Semver},
+		{"filter", img.Filter},
+		{"override_repo_name", img.OverrideRepoName},
+		{"tags", strings.Join(img.Tags, ",")},
+	} {
+		if option.value != "" {
+			parts = append(parts, option.name+"="+option.value)
+		}
+	}
+	// Marshaling the exported fields of an entry read from YAML cannot fail.
+	b, _ := yaml.Marshal(img)
+	sum := sha256.Sum256(b)
+	parts = append(parts, "entry="+hex.EncodeToString(sum[:6]))
+	return strings.Join(parts, " ")
+}
+
+// ShardKey identifies the image for sharding by its source image and
+// destination repository only, so editing other options of the entry keeps it
+// on the same shard with the same weight. Entries copying an image to the same
+// repository share the shard key, and are assigned to the same shard.
+// Example: "quay.io/cilium/cilium cilium"
+func (img *RenamedImage) ShardKey() string {
+	return img.Image + " " + img.repositoryName()
+}
+
+// assignShards returns the shard, in the range [0, count), of every key.
+//
+// Every key prefers shards in the order given by rendezvous hashing of the key
+// and the shard number, so the assignment of an entry does not depend on its
+// position in the file. To balance the work, keys are assigned from the
+// heaviest one, and a shard is skipped once it would get more than
+// (1+shardOverload) times the average weight. Adding or removing an entry
+// therefore only moves entries which spill over to other shards.
+//
+// Equal keys are assigned to the same shard, weighted as a whole. Keys
+// missing in weights get the average known weight per entry. The result is the
+// same for the same keys and weights, which every executor must use.
+func assignShards(entryKeys []string, weights map[string]float64, count int) []int {
+	// index is a map of key -> position in keys, entries is the number of
+	// entries with the key.
+	index := map[string]int{}
+	var keys []string
+	var entries []int
+	for _, key := range entryKeys {
+		if _, ok := index[key]; !ok {
+			index[key] = len(keys)
+			keys = append(keys, key)
+			entries = append(entries, 0)
+		}
+		entries[index[key]]++
+	}
+
+	known, knownTotal := 0, 0.0
+	for i, key := range keys {
+		if w, ok := weights[key]; ok {
+			known += entries[i]
+			knownTotal += w
+		}
+	}
+	defaultWeight := 1.0
+	if known > 0 {
+		defaultWeight = knownTotal / float64(known)
+	}
+
+	keyWeights := make([]float64, len(keys))
+	order := make([]int, len(keys))
+	total, heaviest := 0.0, 0.0
+	for i, key := range keys {
+		keyWeights[i] = defaultWeight * float64(entries[i])
+		if w, ok := weights[key]; ok {
+			keyWeights[i] = w
+		}
+		total += keyWeights[i]
+		heaviest = max(heaviest, keyWeights[i])
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if keyWeights[i] != keyWeights[j] {
+			return keyWeights[i] > keyWeights[j]
+		}
+		return keys[i] < keys[j]
+	})
+
+	capacity := max((1+shardOverload)*total/float64(count), heaviest)
+	loads := make([]float64, count)
+	keyShards := make([]int, len(keys))
+	for _, i := range order {
+		preferred := shardPreference(keys[i], count)
+		shard := preferred[0]
+		for _, s := range preferred {
+			if loads[s]+keyWeights[i] <= capacity {
+				shard = s
+				break
+			}
+			if loads[s] < loads[shard] {
+				shard = s
+			}
+		}
+		loads[shard] += keyWeights[i]
+		keyShards[i] = shard
+	}
+
+	shards := make([]int, len(entryKeys))
+	for i, key := range entryKeys {
+		shards[i] = keyShards[index[key]]
+	}
+	return shards
+}
+
+// shardPreference returns shard numbers ordered by rendezvous hashing score
+// of the key, highest first.
+func shardPreference(key string, count int) []int {
+	scores := make([]uint64, count)
+	shards := make([]int, count)
+	for s := range shards {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key + "\x00" + strconv.Itoa(s)))
+		scores[s] = h.Sum64()
+		shards[s] = s
+	}
+	sort.Slice(shards, func(a, b int) bool {
+		return scores[shards[a]] > scores[shards[b]]
+	})
+	return shards
+}
+
+// loadShardWeights reads JSON reports of previous `retagger run` invocations
+// for the file from paths, which can be files or directories searched
+// recursively. The weight of every shard key is the number of tags matched by
+// its image definitions, plus one for listing the tags of each. Reports read
+// later replace weights of earlier ones.
+func loadShardWeights(paths []string, file string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || (path != p && filepath.Ext(path) != ".json") {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("error reading %q: %w", path, err)
+			}
+			r := report{}
+			if err := json.Unmarshal(b, &r); err != nil {
+				return fmt.Errorf("error unmarshaling %q: %w", path, err)
+			}
+			if r.Command != "run" || filepath.Clean(r.File) != filepath.Clean(file) {
+				return nil
+			}
+			reportWeights := map[string]float64{}
+			for _, image := range r.Images {
+				if image.ShardKey != "" {
+					reportWeights[image.ShardKey] += float64(1 + len(image.MatchedTags))
+				}
+			}
+			for key, weight := range reportWeights {
+				weights[key] = weight
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return weights, nil
+}
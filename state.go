@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// stateHistoryLength is the number of copies remembered per destination tag.
+const stateHistoryLength = 10
+
+var mirrorState = &stateStore{}
+
+// stateStore records tags present in destination repositories and the
+// digests copied to them, in a file CI can cache between runs. It answers
+// which tags are present without querying registries: tags it does not know
+// about are confirmed by listing the repository, so an outdated state never
+// causes tags to be skipped. Tags deleted from a destination are noticed once
+// their records get older than maxAge.
+type stateStore struct {
+	path   string
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	state *mirrorStateFile
+}
+
+type mirrorStateFile struct {
+	// Repositories is a map of destination repository -> tag -> record.
+	// Example: {"gsoci.azurecr.io/giantswarm/cilium": {"v1.15.0": {...}}}
+	Repositories map[string]map[string]*stateTag `json:"repositories"`
+}
+
+type stateTag struct {
+	// Source is the reference last copied to the tag. It is empty for tags
+	// only seen when listing the repository.
+	// Example: "quay.io/cilium/cilium:v1.15.0"
+	Source string `json:"source,omitempty"`
+	// Digest is the manifest digest last copied to the tag.
+	Digest string `json:"digest,omitempty"`
+	// SeenAt is the last time the tag was listed or copied.
+	SeenAt time.Time `json:"seenAt"`
+	// History contains the latest copies to the tag, the latest first.
+	History []stateCopy `json:"history,omitempty"`
+}
+
+type stateCopy struct {
+	Source   string    `json:"source"`
+	Digest   string    `json:"digest"`
+	CopiedAt time.Time `json:"copiedAt"`
+}
+
+// Load reads the state from path. A missing file results in an empty state,
+// which is created on Save. Records older than maxAge are ignored, unless
+// maxAge is 0.
+func (s *stateStore) Load(path string, maxAge time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	s.maxAge = maxAge
+	s.state = &mirrorStateFile{}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.state.Repositories = map[string]map[string]*stateTag{}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading state %q: %w", path, err)
+	}
+	if err := json.Unmarshal(b, s.state); err != nil {
+		return fmt.Errorf("error unmarshaling state %q: %w", path, err)
+	}
+	if s.state.Repositories == nil {
+		s.state.Repositories = map[string]map[string]*stateTag{}
+	}
+	return nil
+}
+
+// PresentTags returns tags of the destination repository known to be
+// present. The boolean is true only if all wanted tags are known to be
+// present, so the repository does not have to be listed. It is always false
+// if the state was not loaded.
+func (s *stateStore) PresentTags(repository string, wanted []string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return nil, false
+	}
+	var present []string
+	records := s.state.Repositories[repository]
+	for tag, record := range records {
+		if s.maxAge == 0 || time.Since(record.SeenAt) <= s.maxAge {
+			present = append(present, tag)
+		}
+	}
+	for _, tag := range wanted {
+		record, ok := records[tag]
+		if !ok || (s.maxAge != 0 && time.Since(record.SeenAt) > s.maxAge) {
+			return present, false
+		}
+	}
+	return present, true
+}
+
+// RecordListed records tags listed in the destination repository.
+func (s *stateStore) RecordListed(repository string, tags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return
+	}
+	now := time.Now().UTC()
+	for _, tag := range tags {
+		s.record(repository, tag).SeenAt = now
+	}
+}
+
+// RecordCopy records a successful copy of source to the destination tag.
+func (s *stateStore) RecordCopy(source, repository, tag, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return
+	}
+	now := time.Now().UTC()
+	record := s.record(repository, tag)
+	record.Source = source
+	record.Digest = digest
+	record.SeenAt = now
+	record.History = append([]stateCopy{{Source: source, Digest: digest, CopiedAt: now}}, record.History...)
+	if len(record.History) > stateHistoryLength {
+		record.History = record.History[:stateHistoryLength]
+	}
+}
+
+// record returns the record of the tag, creating it if needed. It must be
+// called with s.mu locked.
+func (s *stateStore) record(repository, tag string) *stateTag {
+	tags, ok := s.state.Repositories[repository]
+	if !ok {
+		tags = map[string]*stateTag{}
+		s.state.Repositories[repository] = tags
+	}
+	record, ok := tags[tag]
+	if !ok {
+		record = &stateTag{}
+		tags[tag] = record
+	}
+	return record
+}
+
+// Save writes the state to the file it was loaded from. It does nothing if
+// the state was not loaded.
+func (s *stateStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling state: %w", err)
+	}
+	if err := os.WriteFile(s.path, b, 0600); err != nil {
+		return fmt.Errorf("error writing state %q: %w", s.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var tagCache = &tagListCache{}
+
+// tagListCache stores tag lists in a file, so repeated invocations of
+// `retagger plan` do not have to query registries again.
+type tagListCache struct {
+	path string
+	// maxAge is the age after which entries are ignored, so new upstream
+	// tags are eventually listed. 0 disables expiration.
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[string]tagListCacheEntry
+}
+
+type tagListCacheEntry struct {
+	Tags     []string  `json:"tags"`
+	ListedAt time.Time `json:"listedAt"`
+}
+
+// loadTagCache loads the file given with --tag-cache, if any. Only `retagger
+// plan` uses it, `retagger run` always lists tags.
+func loadTagCache() {
+	if flagTagCache == "" {
+		return
+	}
+	if err := tagCache.Load(flagTagCache, flagTagCacheMaxAge); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// Load reads the cache from path. A missing file results in an empty cache,
+// which is created on Save. Entries older than maxAge are not used, and
+// replaced when the image is listed again.
+func (c *tagListCache) Load(path string, maxAge time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.path = path
+	c.maxAge = maxAge
+	c.entries = map[string]tagListCacheEntry{}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading tag cache %q: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return fmt.Errorf("error unmarshaling tag cache %q: %w", path, err)
+	}
+	return nil
+}
+
+// Get returns cached tags of the image. It always misses if the cache was
+// not loaded, and for entries older than the max age.
+func (c *tagListCache) Get(image string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[image]
+	if !ok || (c.maxAge > 0 && time.Since(entry.ListedAt) > c.maxAge) {
+		return nil, false
+	}
+	return entry.Tags, true
+}
+
+// Set stores tags of the image, if the cache was loaded or initialized.
+func (c *tagListCache) Set(image string, tags []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		return
+	}
+	c.entries[image] = tagListCacheEntry{
+		Tags:     tags,
+		ListedAt: time.Now().UTC(),
+	}
+}
+
+// Save writes the cache to the file it was loaded from. It does nothing if
+// the cache was not loaded.
+func (c *tagListCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling tag cache: %w", err)
+	}
+	if err := os.WriteFile(c.path, b, 0600); err != nil {
+		return fmt.Errorf("error writing tag cache %q: %w", c.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTagListCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	cache := &tagListCache{}
+	if err := cache.Load(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("alpine", []string{"3.19", "3.20"})
+	cache.entries["busybox"] = tagListCacheEntry{Tags: []string{"1.36"}, ListedAt: time.Now().Add(-2 * time.Hour)}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &tagListCache{}
+	if err := loaded.Load(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if tags, ok := loaded.Get("alpine"); !ok || len(tags) != 2 {
+		t.Errorf("expected cached tags of alpine, got %v, %t", tags, ok)
+	}
+	if tags, ok := loaded.Get("busybox"); ok {
+		t.Errorf("expected tags of busybox to be expired, got %v", tags)
+	}
+
+	if err := loaded.Load(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Get("busybox"); !ok {
+		t.Error("expected tags of busybox to be used without max age")
+	}
+}
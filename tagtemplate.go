@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// validTagPattern matches tags allowed by the distribution spec.
+var validTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// validTagCharacters matches replacements of characters invalid in tags.
+var validTagCharacters = regexp.MustCompile(`^[a-zA-Z0-9._-]*$`)
+
+// tagReplacer replaces characters invalid in tags, like "+" of semver build
+// metadata, in destination tags. It is configured with --tag-replace flags.
+var tagReplacer = strings.NewReplacer("+", "_")
+
+// destinationTagFuncs are functions available in destination tag templates.
+// Their last argument is the piped value.
+// Example: `{{.Tag | trimPrefix "v" | replace "+" "_"}}`
+var destinationTagFuncs = template.FuncMap{
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+}
+
+// destinationTagData is available in destination tag templates.
+type destinationTagData struct {
+	// Tag is the source tag.
+	// Example: "v1.2.3-alpine"
+	Tag string
+	// Version is the part of the tag compared with Semver, which is the first
+	// group of Filter, or the whole tag.
+	// Example: "v1.2.3"
+	Version string
+	// Major, Minor, Patch, Prerelease, and Metadata are parts of Version. They
+	// are zero values if Version is not a semantic version.
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease string
+	Metadata   string
+	// Groups are the whole match and the groups of Filter, or of TagOrPattern
+	// if Filter is not used. It is empty if the pattern does not match.
+	// Example: `{{index .Groups 1}}`
+	Groups []string
+}
+
+// destinationTagTemplate returns DestinationTag, or the template equivalent
+// to AddTagSuffix and StripSemverPrefix.
+func (img *RenamedImage) destinationTagTemplate() string {
+	if img.DestinationTag != "" {
+		return img.DestinationTag
+	}
+	t := "{{.Tag}}"
+	if img.Semver != "" && img.StripSemverPrefix {
+		t = `{{.Tag | trimPrefix "v"}}`
+	}
+	if img.AddTagSuffix != "" {
+		t += "-" + img.AddTagSuffix
+	}
+	return t
+}
+
+// validateDestinationTag returns an error if the destination tag template is
+// combined with the options it replaces. The template itself is parsed by
+// compileTagTemplates.
+func (img *RenamedImage) validateDestinationTag() error {
+	if img.DestinationTag != "" && (img.AddTagSuffix != "" || img.StripSemverPrefix) {
+		return fmt.Errorf("%q cannot be used with %q or %q", "destination_tag", "add_tag_suffix", "strip_semver_prefix")
+	}
+	return nil
+}
+
+// tagTemplates are the tag patterns and tag templates of an image, compiled
+// once by Validate instead of for every tag.
+type tagTemplates struct {
+	// tagPattern is TagOrPattern compiled, nil if it is not set.
+	tagPattern *regexp.Regexp
+	// semver is Semver compiled, nil if it is not set.
+	semver *semver.Constraints
+	// filter is Filter compiled, nil if it is not set.
+	filter *regexp.Regexp
+	// groups is groupPattern compiled, nil if the image has no pattern.
+	groups *regexp.Regexp
+	// destinationTag is destinationTagTemplate parsed.
+	destinationTag *template.Template
+	// aliasTags are AliasTags parsed, in the same order.
+	aliasTags []*template.Template
+}
+
+// compileTagTemplates returns the tag patterns and tag templates of the
+// image compiled, or an error if any of them is invalid.
+func (img *RenamedImage) compileTagTemplates() (*tagTemplates, error) {
+	compiled := &tagTemplates{}
+	if img.TagOrPattern != "" {
+		pattern, err := regexp.Compile(img.TagOrPattern)
+		if err != nil {
+			return compiled, fmt.Errorf("error compiling regexp pattern %q: %w", img.TagOrPattern, err)
+		}
+		compiled.tagPattern = pattern
+	}
+	if img.Semver != "" {
+		constraint, err := semver.NewConstraint(img.Semver)
+		if err != nil {
+			return compiled, fmt.Errorf("error compiling semver constraint %q: %w", img.Semver, err)
+		}
+		compiled.semver = constraint
+	}
+	if img.Filter != "" {
+		filter, err := regexp.Compile(img.Filter)
+		if err != nil {
+			return compiled, fmt.Errorf("error compiling semver filter %q: %w", img.Filter, err)
+		}
+		compiled.filter = filter
+	}
+	// groupPattern is Filter if set, and TagOrPattern otherwise.
+	compiled.groups = compiled.tagPattern
+	if compiled.filter != nil {
+		compiled.groups = compiled.filter
+	}
+	destinationTag, err := parseTagTemplate(img.destinationTagTemplate())
+	if err != nil {
+		return compiled, fmt.Errorf("invalid %q: %w", "destination_tag", err)
+	}
+	compiled.destinationTag = destinationTag
+	for _, text := range img.AliasTags {
+		aliasTag, err := parseTagTemplate(text)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid %q: %w", "alias_tags", err)
+		}
+		compiled.aliasTags = append(compiled.aliasTags, aliasTag)
+	}
+	return compiled, nil
+}
+
+// templates returns the tag patterns and tag templates compiled by Validate.
+// Images, which are not validated, get them compiled on every call. Invalid
+// ones are left nil then.
+func (img *RenamedImage) templates() *tagTemplates {
+	compiled, _ := img.checkedTemplates()
+	return compiled
+}
+
+// checkedTemplates is like templates, but also returns the error of images,
+// which are not validated.
+func (img *RenamedImage) checkedTemplates() (*tagTemplates, error) {
+	if img.compiledTemplates != nil {
+		return img.compiledTemplates, nil
+	}
+	return img.compileTagTemplates()
+}
+
+// parseTagReplacements parses flag values in the "<from>=<to>" format.
+func parseTagReplacements(flagValues []string) (*strings.Replacer, error) {
+	var oldnew []string
+	for _, value := range flagValues {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid tag replacement %q, expected format is <from>=<to>", value)
+		}
+		if !validTagCharacters.MatchString(to) {
+			return nil, fmt.Errorf("invalid tag replacement %q, %q contains characters invalid in tags", value, to)
+		}
+		oldnew = append(oldnew, from, to)
+	}
+	return strings.NewReplacer(oldnew...), nil
+}
+
+// normalizeTag applies tagReplacer to the tag, and returns an error if the
+// result is not a valid tag.
+// Example: "1.2.3+build.1" -> "1.2.3_build.1"
+func normalizeTag(tag string) (string, error) {
+	normalized := tagReplacer.Replace(tag)
+	if !validTagPattern.MatchString(normalized) {
+		return "", fmt.Errorf("destination tag %q is not a valid tag", normalized)
+	}
+	return normalized, nil
+}
+
+// renderDestinationTag returns the tag the source tag is pushed as, normalized
+// by normalizeTag. It fails if the template cannot be executed for the tag,
+// e.g. because of a missing group, or if the result is not a valid tag.
+// Example: "v1.2.3" -> "1.2.3-giantswarm"
+func (img *RenamedImage) renderDestinationTag(tag string) (string, error) {
+	rendered, err := img.executeDestinationTag(tag)
+	if err != nil {
+		return "", err
+	}
+	normalized, err := normalizeTag(rendered)
+	if err != nil {
+		return "", fmt.Errorf("error normalizing destination tag of %q: %w", tag, err)
+	}
+	return normalized, nil
+}
+
+// executeDestinationTag returns the destination tag template executed for the
+// source tag.
+func (img *RenamedImage) executeDestinationTag(tag string) (string, error) {
+	return img.executeTagTemplate(img.templates().destinationTag, tag)
+}
+
+// executeTagTemplate returns the template executed for the source tag. It
+// fails for a nil template, which could not be parsed.
+func (img *RenamedImage) executeTagTemplate(t *template.Template, tag string) (string, error) {
+	if t == nil {
+		return "", fmt.Errorf("error rendering tag template for %q: invalid template", tag)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, img.tagData(tag)); err != nil {
+		return "", fmt.Errorf("error rendering tag template for %q: %w", tag, err)
+	}
+	return sb.String(), nil
+}
+
+func parseTagTemplate(text string) (*template.Template, error) {
+	return template.New("tag").Funcs(destinationTagFuncs).Option("missingkey=error").Parse(text)
+}
+
+// tagData returns data of the source tag available in tag templates.
+func (img *RenamedImage) tagData(tag string) destinationTagData {
+	data := destinationTagData{Tag: tag, Version: tag}
+	if pattern := img.templates().groups; pattern != nil {
+		data.Groups = pattern.FindStringSubmatch(tag)
+		if img.Filter != "" && len(data.Groups) > 1 {
+			data.Version = data.Groups[1]
+		}
+	}
+	if version, err := semver.NewVersion(data.Version); err == nil {
+		data.Major = version.Major()
+		data.Minor = version.Minor()
+		data.Patch = version.Patch()
+		data.Prerelease = version.Prerelease()
+		data.Metadata = version.Metadata()
+	}
+	return data
+}
+
+// withDestinationTags returns tags, whose destination tag can be rendered.
+// Other tags are logged and skipped, like tags not matching the filters. It
+// also returns a map of source tag -> destination tag of tags changed by
+// normalizeTag.
+func (img *RenamedImage) withDestinationTags(tags []string) ([]string, map[string]string) {
+	var filteredTags []string
+	var normalizedTags map[string]string
+	for _, tag := range tags {
+		destinationTag, err := img.renderDestinationTag(tag)
+		if err != nil {
+			logrus.Warnf("image %q: skipping tag: %v", img.Image, err)
+			continue
+		}
+		filteredTags = append(filteredTags, tag)
+		if rendered, _ := img.executeDestinationTag(tag); rendered != destinationTag {
+			if normalizedTags == nil {
+				normalizedTags = map[string]string{}
+			}
+			normalizedTags[tag] = destinationTag
+		}
+	}
+	return filteredTags, normalizedTags
+}
+
+// destinationTag returns the tag the source tag is pushed as. Tags, which
+// cannot be rendered, are removed by withDestinationTags while planning. The
+// source tag is returned for them, and for digests listed in skopeo files.
+func (img *RenamedImage) destinationTag(tag string) string {
+	destinationTag, err := img.renderDestinationTag(tag)
+	if err != nil {
+		return tag
+	}
+	return destinationTag
+}
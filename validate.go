@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	renamedFilePrefix = "renamed-"
+	skopeoFilePrefix  = "skopeo-"
+)
+
+var (
+	shaPattern    = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// validationProblem is a single problem found in an images file.
+type validationProblem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p validationProblem) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+// fileValidator collects problems found in a single file.
+type fileValidator struct {
+	file     string
+	problems []validationProblem
+	// uses are destination repositories used by the file's entries, checked
+	// for collisions across all files.
+	uses []repositoryUse
+	// settings are registry settings of the file's skopeo registry sections,
+	// checked for conflicts across all files.
+	settings []registrySettingsUse
+}
+
+func (v *fileValidator) addf(node *yaml.Node, format string, args ...interface{}) {
+	p := validationProblem{
+		File:    v.file,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if node != nil {
+		p.Line = node.Line
+		p.Column = node.Column
+	}
+	v.problems = append(v.problems, p)
+}
+
+// commandValidate is invoked when `retagger validate [paths...]` is called.
+//
+// It strictly parses every renamed-*.yaml and skopeo-*.yaml file found in the
+// paths, which default to the images/ directory, and reports all problems
+// found in all files at once.
+func commandValidate(paths []string) {
+	if len(paths) == 0 {
+		paths = []string{"images"}
+	}
+
+	files, err := imageFiles(paths)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	loadRegistries()
+
+	var problems []validationProblem
+	var uses []repositoryUse
+	var settings []registrySettingsUse
+	for _, file := range files {
+		v := validateFile(file)
+		problems = append(problems, v.problems...)
+		uses = append(uses, v.uses...)
+		settings = append(settings, v.settings...)
+	}
+	problems = append(problems, findCollisions(uses)...)
+	problems = append(problems, findRegistryConflicts(settings)...)
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		logrus.Fatalf("Found %d problems in %d files", len(problems), len(files))
+	}
+	logrus.Infof("Validated %d files with no problems", len(files))
+}
+
+// imageFiles returns renamed and skopeo files in paths. Directories are
+// searched non-recursively. Files given explicitly are always returned.
+func imageFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, filepath.Clean(p))
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || imageFileKind(e.Name()) == "" {
+				continue
+			}
+			files = append(files, filepath.Join(p, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// imageFileKind returns "renamed" or "skopeo" based on the file name, or an
+// empty string for other files.
+func imageFileKind(path string) string {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, ".yaml") {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(name, renamedFilePrefix):
+		return "renamed"
+	case strings.HasPrefix(name, skopeoFilePrefix):
+		return "skopeo"
+	}
+	return ""
+}
+
+func validateFile(path string) *fileValidator {
+	v := &fileValidator{file: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		v.addf(nil, "%v", err)
+		return v
+	}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(b, root); err != nil {
+		v.addf(nil, "%v", err)
+		return v
+	}
+	if len(root.Content) == 0 {
+		v.addf(root, "file is empty")
+		return v
+	}
+	doc := root.Content[0]
+
+	switch imageFileKind(path) {
+	case "renamed":
+		v.validateRenamedFile(doc)
+	case "skopeo":
+		v.validateSkopeoFile(doc)
+	default:
+		v.addf(nil, "unknown file type, expected %s*.yaml or %s*.yaml", renamedFilePrefix, skopeoFilePrefix)
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v
+}
+
+func (v *fileValidator) validateRenamedFile(doc *yaml.Node) {
+	if doc.Kind != yaml.SequenceNode {
+		v.addf(doc, "expected a list of images")
+		return
+	}
+	for _, item := range doc.Content {
+		v.checkKnownFields(item, reflect.TypeOf(RenamedImage{}))
+		img := RenamedImage{}
+		if err := item.Decode(&img); err != nil {
+			v.addf(item, "%v", err)
+			continue
+		}
+		v.validateRenamedImage(item, img)
+	}
+}
+
+func (v *fileValidator) validateRenamedImage(node *yaml.Node, img RenamedImage) {
+	if img.Image == "" {
+		v.addf(node, "%q is required", "image")
+		return
+	}
+	if _, err := parseReference(img.Image); err != nil {
+		v.addf(valueNode(node, "image"), "%v", err)
+	}
+	if err := img.Validate(); err != nil {
+		v.addf(node, "%s: %v", img.Image, err)
+	}
+	// In SHA mode, TagOrPattern is used as a tag, not as a pattern.
+	if img.TagOrPattern != "" && img.SHA == "" {
+		if _, err := regexp.Compile(img.TagOrPattern); err != nil {
+			v.addf(valueNode(node, "tag_or_pattern"), "%s: invalid pattern: %v", img.Image, err)
+		}
+	}
+	if img.SHA != "" && !shaPattern.MatchString(img.SHA) {
+		v.addf(valueNode(node, "sha"), "%s: %q is not 64 lowercase hex characters", img.Image, img.SHA)
+	}
+	if img.Semver != "" {
+		if _, err := semver.NewConstraint(img.Semver); err != nil {
+			v.addf(valueNode(node, "semver"), "%s: invalid semver constraint: %v", img.Image, err)
+		}
+	}
+	if img.Filter != "" {
+		filter, err := regexp.Compile(img.Filter)
+		if err != nil {
+			v.addf(valueNode(node, "filter"), "%s: invalid filter: %v", img.Image, err)
+		} else if filter.NumSubexp() < 1 {
+			v.addf(valueNode(node, "filter"), "%s: filter %q has no capture group", img.Image, img.Filter)
+		}
+	}
+
+	v.addUses(node, img.Image, img.repositoryName(), img.selectedDestinations(), img.AllowCollision)
+}
+
+func (v *fileValidator) validateSkopeoFile(doc *yaml.Node) {
+	if doc.Kind != yaml.MappingNode {
+		v.addf(doc, "expected a map of registries")
+		return
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		registryName, section := doc.Content[i].Value, doc.Content[i+1]
+		v.checkKnownFields(section, reflect.TypeOf(skopeoFileRegistry{}))
+		registry := skopeoFileRegistry{}
+		if err := section.Decode(&registry); err != nil {
+			v.addf(section, "%v", err)
+			continue
+		}
+		v.settings = append(v.settings, registrySettingsUse{
+			Registry: registryName,
+			Settings: registry.settings(),
+			File:     v.file,
+			Line:     doc.Content[i].Line,
+			Column:   doc.Content[i].Column,
+		})
+
+		for name, tags := range registry.Images {
+			node := valueNode(valueNode(section, "images"), name)
+			for _, tag := range tags {
+				if strings.Contains(tag, ":") && !digestPattern.MatchString(tag) {
+					v.addf(node, "%s/%s: %q is not a valid tag or sha256 digest", registryName, name, tag)
+				}
+			}
+		}
+		for name, pattern := range registry.ImagesByTagRegex {
+			if _, err := regexp.Compile(pattern); err != nil {
+				v.addf(valueNode(valueNode(section, "images-by-tag-regex"), name), "%s/%s: invalid pattern: %v", registryName, name, err)
+			}
+		}
+		for name, constraint := range registry.ImagesBySemver {
+			if _, err := semver.NewConstraint(constraint); err != nil {
+				v.addf(valueNode(valueNode(section, "images-by-semver"), name), "%s/%s: invalid semver constraint: %v", registryName, name, err)
+			}
+		}
+		for name, options := range registry.ImageOptions {
+			node := valueNode(valueNode(section, "image-options"), name)
+			if !registry.hasImage(name) {
+				v.addf(node, "%s/%s: options defined for an image which is not synced", registryName, name)
+			}
+			if len(options.Destinations) > 0 && len(options.ExcludeDestinations) > 0 {
+				v.addf(node, "%s/%s: %q and %q are mutually exclusive", registryName, name, "destinations", "exclude-destinations")
+			}
+			v.validateDestinationNames(valueNode(node, "destinations"), registryName+"/"+name, options.Destinations)
+			v.validateDestinationNames(valueNode(node, "exclude-destinations"), registryName+"/"+name, options.ExcludeDestinations)
+			if _, err := compileMutableTags(options.MutableTags); err != nil {
+				v.addf(valueNode(node, "mutable-tags"), "%s/%s: invalid %q: %v", registryName, name, "mutable-tags", err)
+			}
+			if len(options.Platforms) > 0 {
+				v.addf(valueNode(node, "platforms"), "%s/%s: %v", registryName, name, errSkopeoPlatforms)
+			}
+		}
+
+		for _, list := range []string{"images", "images-by-tag-regex", "images-by-semver"} {
+			listNode := valueNode(section, list)
+			if listNode == section {
+				continue
+			}
+			for j := 0; j+1 < len(listNode.Content); j += 2 {
+				name := listNode.Content[j].Value
+				options := registry.ImageOptions[name]
+				image := registryName + "/" + name
+				v.addUses(listNode.Content[j], image, imageBaseName(image), options.selectedDestinations(), options.AllowCollision)
+			}
+		}
+	}
+}
+
+func (v *fileValidator) validateDestinationNames(node *yaml.Node, image string, names []string) {
+	if err := validateDestinationNames(names); err != nil {
+		v.addf(node, "%s: %v", image, err)
+	}
+}
+
+// checkKnownFields reports mapping keys, which do not match any `yaml` tag of
+// the struct type t, recursing into nested structs, slices, and maps.
+// Unknown keys are otherwise silently ignored by yaml.Unmarshal.
+func (v *fileValidator) checkKnownFields(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return // Reported by Decode.
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldType, known := fields[key.Value]
+			if !known {
+				v.addf(key, "unknown field %q, known fields are: %s", key.Value, strings.Join(sortedKeys(fields), ", "))
+				continue
+			}
+			v.checkKnownFields(node.Content[i+1], fieldType)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range node.Content {
+			v.checkKnownFields(item, t.Elem())
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			v.checkKnownFields(node.Content[i], t.Elem())
+		}
+	}
+}
+
+// valueNode returns the value of key in the mapping node. If the key is not
+// found, node itself is returned, so problems can still be positioned.
+func valueNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return node
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return node
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}